@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+//broker is a configured EMQ broker and the exporter of its metrics
+type broker struct {
+	cfg      brokerConfig
+	client   *client.Client
+	exporter *Exporter
+	//stops polling the broker and watching its credentials
+	cancel context.CancelFunc
+}
+
+//newBroker creates the client and exporter of a broker. Brokers without
+//credentials of their own share the default ones, the files of their own
+//credentials are checked for changes every credsReloadInterval
+func newBroker(cfg brokerConfig, defaults *credentialsCache, credsReloadInterval time.Duration) (*broker, error) {
+	creds := defaults
+	switch {
+	case cfg.Username != "":
+		creds = &credentialsCache{providers: []CredentialProvider{staticProvider{Username: cfg.Username, Password: cfg.Password}}}
+	case cfg.CredsFile != "":
+		creds = &credentialsCache{providers: []CredentialProvider{fileProvider(cfg.CredsFile)}}
+	case creds == nil:
+		creds = &credentialsCache{}
+	}
+
+	if err := creds.reload(); err != nil {
+		return nil, fmt.Errorf("Failed to load credentials: %v", err)
+	}
+
+	filter, err := newMetricFilter(cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	renamer, err := newRenamer(cfg.RenameRules)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts, client.WithCredentialsLoader(func() (client.Credentials, error) {
+		err := creds.reload()
+		return creds.get(), err
+	}))
+
+	if cfg.DiscoverNodes {
+		opts = append(opts, client.WithNodeDiscovery())
+	}
+
+	//in auto mode the api version is detected by the first scrape, so
+	//unreachable brokers don't hold up loading the others
+	cr := creds.get()
+	c := client.NewClient(cfg.URI, cfg.Node, cfg.APIVersion, cr.Username, cr.Password, opts...)
+
+	labels := prometheus.Labels{}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	if cfg.Name != "" {
+		labels[brokerLabel] = cfg.Name
+	}
+
+	//the metrics of discovered nodes are only told apart by their own labels
+	node := cfg.Node
+	if cfg.DiscoverNodes {
+		node = ""
+	}
+
+	b := &broker{
+		cfg:    cfg,
+		client: c,
+		exporter: NewExporter(c, WithConstLabels(labels), WithNodeLabel(node), WithFilter(filter), WithRenamer(renamer),
+			WithStaleGracePeriod(cfg.StaleGracePeriod), WithPollInterval(cfg.PollInterval)),
+	}
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+
+	if cfg.PollInterval > 0 {
+		go b.exporter.Poll(ctx)
+	}
+
+	//the files of the default providers are watched once for all the brokers
+	if credsReloadInterval > 0 && creds != defaults {
+		for _, path := range credentialFiles(creds.providers) {
+			go watchFile(ctx, path, credsReloadInterval, b.reloadCredentials)
+		}
+	}
+
+	return b, nil
+}
+
+//clientOptions returns the options of the broker's clients, used by probes
+//as well, so node discovery and credentials are left out. The clients
+//created with the options share their connections
+func (cfg brokerConfig) clientOptions() ([]client.Option, error) {
+	opts := []client.Option{
+		client.WithConcurrency(cfg.MaxConcurrentRequests),
+		client.WithTimeout(cfg.Timeout),
+	}
+
+	tc, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS configuration: %v", err)
+	}
+	if tc != nil {
+		opts = append(opts, client.WithTransport(client.NewTLSTransport(tc)))
+	}
+
+	if cfg.Lists.Subscriptions || cfg.Lists.Topics || cfg.Lists.Clients {
+		opts = append(opts, client.WithListCollectors(client.ListConfig(cfg.Lists)))
+	}
+
+	//api keys are sent with basic auth, the default
+	if cfg.AuthMethod == "token" {
+		opts = append(opts, client.WithTokenAuth())
+	}
+
+	return opts, nil
+}
+
+//brokerSet is the set of brokers being scraped, replaced as a whole when
+//the configuration file is reloaded
+type brokerSet struct {
+	defaults *credentialsCache
+	//how often the credentials files of the brokers are checked for changes
+	credsReloadInterval time.Duration
+
+	mu      sync.RWMutex
+	brokers []*broker
+
+	//serializes reloads
+	reloadMu sync.Mutex
+}
+
+//exporters returns the exporters of the current brokers
+func (s *brokerSet) exporters() []*Exporter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]*Exporter, 0, len(s.brokers))
+	for _, b := range s.brokers {
+		res = append(res, b.exporter)
+	}
+
+	return res
+}
+
+//set replaces the brokers
+func (s *brokerSet) set(brokers []*broker) {
+	s.mu.Lock()
+	s.brokers = brokers
+	s.mu.Unlock()
+}
+
+//load replaces the brokers with the ones of the configuration file at path.
+//Brokers whose configuration didn't change are kept as is, along with
+//their state. Nothing is replaced when the configuration is invalid
+func (s *brokerSet) load(path string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	current := make(map[string]*broker, len(s.brokers))
+	for _, b := range s.brokers {
+		current[b.cfg.Name] = b
+	}
+	s.mu.RUnlock()
+
+	brokers := make([]*broker, 0, len(cfg.Brokers))
+
+	for _, bc := range cfg.Brokers {
+		if b, ok := current[bc.Name]; ok && reflect.DeepEqual(b.cfg, bc) {
+			brokers = append(brokers, b)
+			continue
+		}
+
+		b, err := newBroker(bc, s.defaults, s.credsReloadInterval)
+		if err != nil {
+			//stop the brokers created so far
+			for _, nb := range brokers {
+				if current[nb.cfg.Name] != nb {
+					nb.cancel()
+				}
+			}
+			return fmt.Errorf("broker %s: %v", bc.Name, err)
+		}
+		brokers = append(brokers, b)
+	}
+
+	s.set(brokers)
+
+	//stop the brokers that were replaced
+	for _, b := range current {
+		if !containsBroker(brokers, b) {
+			b.cancel()
+		}
+	}
+
+	log.Info().Msgf("Loaded %d brokers from %s", len(brokers), path)
+
+	return nil
+}
+
+//containsBroker checks if b is one of the brokers
+func containsBroker(brokers []*broker, b *broker) bool {
+	for _, other := range brokers {
+		if other == b {
+			return true
+		}
+	}
+	return false
+}
+
+//credentials returns the current credentials of the broker at uri, false
+//is returned when no broker is configured at uri
+func (s *brokerSet) credentials(uri string) (client.Credentials, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, b := range s.brokers {
+		if targetKey(b.cfg.URI) == targetKey(uri) {
+			return b.client.Credentials(), true
+		}
+	}
+
+	return client.Credentials{}, false
+}
+
+//reloadCredentials reloads the credentials of all the brokers
+func (s *brokerSet) reloadCredentials() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, b := range s.brokers {
+		b.reloadCredentials()
+	}
+}
+
+//reloadCredentials reloads the credentials of the broker
+func (b *broker) reloadCredentials() {
+	if _, err := b.client.ReloadCredentials(); err != nil {
+		log.Error().Err(err).Msgf("Failed to reload the credentials of %s", b.cfg.URI)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+)
+
+//metricInfo describes a known EMQ metric
+type metricInfo struct {
+	help string
+	unit string
+}
+
+//catalogue maps the keys returned by the EMQ v2, v3, v4 and v5 apis, with `/` and `.`
+//replaced by `_`, to a human readable description
+var catalogue = map[string]metricInfo{
+	//exporter
+	"scrape_success":          {"Was the last scrape of the EMQ endpoint successful", ""},
+	"scrape_duration_seconds": {"Duration of the last scrape of the EMQ endpoint", "seconds"},
+	"build_info":              {"A metric with a constant '1' value labeled by the detected api version and release of the node", ""},
+
+	//node info
+	"connections":       {"Number of clients currently connected to the node", ""},
+	"load1":             {"System load average over the last minute", ""},
+	"load5":             {"System load average over the last 5 minutes", ""},
+	"load15":            {"System load average over the last 15 minutes", ""},
+	"max_fds":           {"Maximum number of file descriptors", ""},
+	"memory_total":      {"Memory allocated by the Erlang VM", "bytes"},
+	"memory_used":       {"Memory used by the Erlang VM", "bytes"},
+	"process_available": {"Maximum number of Erlang processes", ""},
+	"process_used":      {"Number of Erlang processes in use", ""},
+	"live_connections":  {"Number of clients currently connected to the node, excluding persistent sessions", ""},
+	"uptime":            {"Time since the node started", "milliseconds"},
+
+	//bytes
+	"bytes_received": {"Number of bytes received", "bytes"},
+	"bytes_sent":     {"Number of bytes sent", "bytes"},
+
+	//messages
+	"messages_received":      {"Number of messages received", ""},
+	"messages_sent":          {"Number of messages sent", ""},
+	"messages_dropped":       {"Number of messages dropped", ""},
+	"messages_expired":       {"Number of expired messages", ""},
+	"messages_forward":       {"Number of messages forwarded to other nodes", ""},
+	"messages_retained":      {"Number of retained messages", ""},
+	"messages_delayed":       {"Number of delayed messages", ""},
+	"messages_acked":         {"Number of acknowledged messages", ""},
+	"messages_qos0_received": {"Number of QoS 0 messages received", ""},
+	"messages_qos0_sent":     {"Number of QoS 0 messages sent", ""},
+	"messages_qos1_received": {"Number of QoS 1 messages received", ""},
+	"messages_qos1_sent":     {"Number of QoS 1 messages sent", ""},
+	"messages_qos2_received": {"Number of QoS 2 messages received", ""},
+	"messages_qos2_sent":     {"Number of QoS 2 messages sent", ""},
+	"messages_qos2_dropped":  {"Number of QoS 2 messages dropped", ""},
+	"messages_qos2_expired":  {"Number of QoS 2 messages expired", ""},
+
+	//packets
+	"packets_received":             {"Number of MQTT packets received", ""},
+	"packets_sent":                 {"Number of MQTT packets sent", ""},
+	"packets_connect":              {"Number of CONNECT packets received", ""},
+	"packets_connect_received":     {"Number of CONNECT packets received", ""},
+	"packets_connack":              {"Number of CONNACK packets sent", ""},
+	"packets_connack_sent":         {"Number of CONNACK packets sent", ""},
+	"packets_auth":                 {"Number of AUTH packets received", ""},
+	"packets_auth_received":        {"Number of AUTH packets received", ""},
+	"packets_auth_sent":            {"Number of AUTH packets sent", ""},
+	"packets_disconnect_received":  {"Number of DISCONNECT packets received", ""},
+	"packets_disconnect_sent":      {"Number of DISCONNECT packets sent", ""},
+	"packets_pingreq":              {"Number of PINGREQ packets received", ""},
+	"packets_pingreq_received":     {"Number of PINGREQ packets received", ""},
+	"packets_pingresp":             {"Number of PINGRESP packets sent", ""},
+	"packets_pingresp_sent":        {"Number of PINGRESP packets sent", ""},
+	"packets_publish_received":     {"Number of PUBLISH packets received", ""},
+	"packets_publish_sent":         {"Number of PUBLISH packets sent", ""},
+	"packets_puback_received":      {"Number of PUBACK packets received", ""},
+	"packets_puback_sent":          {"Number of PUBACK packets sent", ""},
+	"packets_puback_missed":        {"Number of PUBACK packets missed", ""},
+	"packets_pubrec_received":      {"Number of PUBREC packets received", ""},
+	"packets_pubrec_sent":          {"Number of PUBREC packets sent", ""},
+	"packets_pubrec_missed":        {"Number of PUBREC packets missed", ""},
+	"packets_pubrel_received":      {"Number of PUBREL packets received", ""},
+	"packets_pubrel_sent":          {"Number of PUBREL packets sent", ""},
+	"packets_pubrel_missed":        {"Number of PUBREL packets missed", ""},
+	"packets_pubcomp_received":     {"Number of PUBCOMP packets received", ""},
+	"packets_pubcomp_sent":         {"Number of PUBCOMP packets sent", ""},
+	"packets_pubcomp_missed":       {"Number of PUBCOMP packets missed", ""},
+	"packets_subscribe":            {"Number of SUBSCRIBE packets received", ""},
+	"packets_subscribe_received":   {"Number of SUBSCRIBE packets received", ""},
+	"packets_suback":               {"Number of SUBACK packets sent", ""},
+	"packets_suback_sent":          {"Number of SUBACK packets sent", ""},
+	"packets_unsubscribe":          {"Number of UNSUBSCRIBE packets received", ""},
+	"packets_unsubscribe_received": {"Number of UNSUBSCRIBE packets received", ""},
+	"packets_unsuback":             {"Number of UNSUBACK packets sent", ""},
+	"packets_unsuback_sent":        {"Number of UNSUBACK packets sent", ""},
+
+	//clients and sessions
+	"client_connect":        {"Number of client connection attempts", ""},
+	"client_connected":      {"Number of successful client connections", ""},
+	"client_disconnected":   {"Number of client disconnections", ""},
+	"client_subscribe":      {"Number of client subscriptions", ""},
+	"client_unsubscribe":    {"Number of client unsubscriptions", ""},
+	"client_authenticate":   {"Number of client authentications", ""},
+	"client_auth_anonymous": {"Number of anonymous client logins", ""},
+	"session_created":       {"Number of sessions created", ""},
+	"session_resumed":       {"Number of sessions resumed", ""},
+	"session_takeovered":    {"Number of sessions taken over", ""},
+	"session_discarded":     {"Number of sessions discarded", ""},
+	"session_terminated":    {"Number of sessions terminated", ""},
+
+	//stats
+	"clients_count":              {"Number of connected clients", ""},
+	"clients_max":                {"Historical maximum number of connected clients", ""},
+	"connections_count":          {"Number of connections", ""},
+	"connections_max":            {"Historical maximum number of connections", ""},
+	"channels_count":             {"Number of channels", ""},
+	"channels_max":               {"Historical maximum number of channels", ""},
+	"sessions_count":             {"Number of sessions", ""},
+	"sessions_max":               {"Historical maximum number of sessions", ""},
+	"sessions_persistent_count":  {"Number of persistent sessions", ""},
+	"sessions_persistent_max":    {"Historical maximum number of persistent sessions", ""},
+	"subscriptions_count":        {"Number of subscriptions", ""},
+	"subscriptions_max":          {"Historical maximum number of subscriptions", ""},
+	"subscriptions_shared_count": {"Number of shared subscriptions", ""},
+	"subscriptions_shared_max":   {"Historical maximum number of shared subscriptions", ""},
+	"subscribers_count":          {"Number of subscribers", ""},
+	"subscribers_max":            {"Historical maximum number of subscribers", ""},
+	"suboptions_count":           {"Number of subscription options", ""},
+	"suboptions_max":             {"Historical maximum number of subscription options", ""},
+	"topics_count":               {"Number of topics", ""},
+	"topics_max":                 {"Historical maximum number of topics", ""},
+	"routes_count":               {"Number of routes", ""},
+	"routes_max":                 {"Historical maximum number of routes", ""},
+	"retained_count":             {"Number of retained messages", ""},
+	"retained_max":               {"Historical maximum number of retained messages", ""},
+	"live_connections_count":     {"Number of live connections", ""},
+	"live_connections_max":       {"Historical maximum number of live connections", ""},
+
+	//current rates and totals, v5 only
+	"subscriptions":      {"Number of subscriptions", ""},
+	"topics":             {"Number of topics", ""},
+	"retained_msg_count": {"Number of retained messages", ""},
+	"received_msg_rate":  {"Rate of messages received", "messages per second"},
+	"sent_msg_rate":      {"Rate of messages sent", "messages per second"},
+	"dropped_msg_rate":   {"Rate of messages dropped", "messages per second"},
+
+	//listeners
+	"current_conns": {"Number of connections currently handled by the listener", ""},
+	"max_conns":     {"Maximum number of connections allowed by the listener", ""},
+	"acceptors":     {"Number of acceptor processes of the listener", ""},
+
+	//subscriptions and topics lists, by full name
+	"subscriptions_listed":    {"Number of subscriptions of the node listed by the api", ""},
+	"subscriptions_shared":    {"Number of shared subscriptions of the node listed by the api", ""},
+	"subscriptions_by_qos":    {"Number of subscriptions of the node listed by the api, by QoS", ""},
+	"subscriptions_truncated": {"Whether the subscriptions list had more pages than allowed, making the subscriptions aggregates partial", ""},
+	"topics_listed":           {"Number of topics subscribed on the node listed by the api", ""},
+	"topics_by_prefix":        {"Number of topics subscribed on the node listed by the api, by top level prefix", ""},
+	"topics_truncated":        {"Whether the topics list had more pages than allowed, making the topics aggregates partial", ""},
+	"clients_listed":          {"Number of clients of the node listed by the api", ""},
+	"clients_top":             {"Value of the client field of the clients with the highest values in the cluster", ""},
+	"clients_truncated":       {"Whether the clients list had more pages than allowed, making the clients aggregates partial", ""},
+	"clients_mqueue_len":      {"Distribution of the message queue lengths of the clients of the node", ""},
+	"clients_inflight":        {"Distribution of the inflight messages of the clients of the node", ""},
+	"clients_recv_msg":        {"Distribution of the messages received by the clients of the node", ""},
+}
+
+//staticSamples are the samples whose name and labels are known in advance,
+//their metrics are described before the first scrape. The names of the
+//other metrics depend on the responses of EMQ
+var staticSamples = []client.Sample{
+	{Name: "scrape_success", Labels: labelSet("node", "endpoint")},
+	{Name: "scrape_duration_seconds", Labels: labelSet("node", "endpoint")},
+	{Name: "build_info", Labels: labelSet("node", "api_version", "release")},
+	{Name: "listeners_current_conns", Endpoint: "listeners", Labels: labelSet("node", "protocol", "listen_on")},
+	{Name: "listeners_max_conns", Endpoint: "listeners", Labels: labelSet("node", "protocol", "listen_on")},
+	{Name: "listeners_acceptors", Endpoint: "listeners", Labels: labelSet("node", "protocol", "listen_on")},
+	{Name: "subscriptions_listed", Endpoint: "subscriptions", Labels: labelSet("node")},
+	{Name: "subscriptions_shared", Endpoint: "subscriptions", Labels: labelSet("node")},
+	{Name: "subscriptions_truncated", Endpoint: "subscriptions", Labels: labelSet("node")},
+	{Name: "subscriptions_by_qos", Endpoint: "subscriptions", Labels: labelSet("node", "qos")},
+	{Name: "topics_listed", Endpoint: "topics", Labels: labelSet("node")},
+	{Name: "topics_truncated", Endpoint: "topics", Labels: labelSet("node")},
+	{Name: "topics_by_prefix", Endpoint: "topics", Labels: labelSet("node", "prefix")},
+	{Name: "clients_listed", Endpoint: "clients", Labels: labelSet("node")},
+	{Name: "clients_truncated", Endpoint: "clients", Labels: labelSet("node")},
+	{Name: "clients_top", Endpoint: "clients", Labels: labelSet("node", "client_id", "field")},
+}
+
+//labelSet returns labels with the given names and empty values
+func labelSet(names ...string) map[string]string {
+	labels := make(map[string]string, len(names))
+	for _, n := range names {
+		labels[n] = ""
+	}
+	return labels
+}
+
+//describe returns the help text of a sample, falling back to its name for
+//unknown keys
+func describe(s client.Sample) string {
+	key := strings.TrimPrefix(s.Name, s.Endpoint+"_")
+	key = strings.NewReplacer("/", "_", ".", "_").Replace(key)
+
+	info, ok := catalogue[key]
+	if !ok {
+		//the metrics of the lists are named after their endpoint
+		info, ok = catalogue[s.Name]
+	}
+	if !ok {
+		return "EMQ metric " + s.Name
+	}
+
+	if info.unit != "" {
+		return fmt.Sprintf("%s (%s)", info.help, info.unit)
+	}
+
+	return info.help
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultNode       = "emq@127.0.0.1"
+	defaultAPIVersion = "v3"
+	defaultAuthMethod = "basic"
+	//label added to the metrics of every broker in the configuration file
+	brokerLabel = "broker"
+)
+
+var (
+	apiVersions = map[string]bool{"v2": true, "v3": true, "v4": true, "v5": true, client.AutoVersion: true}
+	authMethods = map[string]bool{"basic": true, "token": true}
+	labelName   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+//config is the configuration file of the exporter, describing the brokers
+//to scrape
+type config struct {
+	Brokers     []brokerConfig `yaml:"brokers"`
+	RenameRules []renameRule   `yaml:"rename_rules"`
+}
+
+//brokerConfig configures the scraping of a single broker, the emq flags
+//configure a single unnamed broker the same way
+type brokerConfig struct {
+	Name                  string            `yaml:"name"`
+	URI                   string            `yaml:"uri"`
+	Node                  string            `yaml:"node"`
+	DiscoverNodes         bool              `yaml:"discover_nodes"`
+	APIVersion            string            `yaml:"api_version"`
+	AuthMethod            string            `yaml:"auth_method"`
+	Username              string            `yaml:"username"`
+	Password              string            `yaml:"password"`
+	CredsFile             string            `yaml:"creds_file"`
+	Timeout               time.Duration     `yaml:"timeout"`
+	MaxConcurrentRequests int               `yaml:"max_concurrent_requests"`
+	StaleGracePeriod      time.Duration     `yaml:"stale_grace_period"`
+	PollInterval          time.Duration     `yaml:"poll_interval"`
+	TLS                   brokerTLSConfig   `yaml:"tls"`
+	Lists                 brokerListsConfig `yaml:"lists"`
+	Labels                map[string]string `yaml:"labels"`
+	Filters               filterConfig      `yaml:"filters"`
+	//shared by all the brokers, as their metrics are served together
+	RenameRules []renameRule `yaml:"-"`
+}
+
+type brokerTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+//brokerListsConfig has the fields of client.ListConfig
+type brokerListsConfig struct {
+	Subscriptions    bool      `yaml:"subscriptions"`
+	Topics           bool      `yaml:"topics"`
+	PageSize         int       `yaml:"page_size"`
+	MaxPages         int       `yaml:"max_pages"`
+	MaxTopicPrefixes int       `yaml:"max_topic_prefixes"`
+	Clients          bool      `yaml:"clients"`
+	ClientFields     []string  `yaml:"client_fields"`
+	TopClients       int       `yaml:"top_clients"`
+	ClientBuckets    []float64 `yaml:"client_buckets"`
+}
+
+//loadConfig reads and validates the configuration file at path
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	//relative paths are relative to the configuration file
+	dir := filepath.Dir(path)
+	for i := range cfg.Brokers {
+		b := &cfg.Brokers[i]
+		for _, f := range []*string{&b.CredsFile, &b.TLS.CAFile, &b.TLS.CertFile, &b.TLS.KeyFile} {
+			if *f != "" && !filepath.IsAbs(*f) {
+				*f = filepath.Join(dir, *f)
+			}
+		}
+		b.setDefaults()
+		b.RenameRules = cfg.RenameRules
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+//setDefaults fills in the settings left empty
+func (b *brokerConfig) setDefaults() {
+	if b.Node == "" {
+		b.Node = defaultNode
+	}
+	if b.APIVersion == "" {
+		b.APIVersion = defaultAPIVersion
+	}
+	if b.AuthMethod == "" {
+		b.AuthMethod = defaultAuthMethod
+	}
+}
+
+//validate checks the configuration, the errors point at the invalid broker
+func (c *config) validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("no brokers configured")
+	}
+
+	if _, err := newRenamer(c.RenameRules); err != nil {
+		return err
+	}
+
+	names := make(map[string]int, len(c.Brokers))
+
+	for i, b := range c.Brokers {
+		if b.Name == "" {
+			return fmt.Errorf("brokers[%d]: name is required", i)
+		}
+
+		if j, ok := names[b.Name]; ok {
+			return fmt.Errorf("brokers[%d]: name %q is already used by brokers[%d]", i, b.Name, j)
+		}
+		names[b.Name] = i
+
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("brokers[%d] (%s): %v", i, b.Name, err)
+		}
+
+		//metrics of all the brokers are served together, so they must have
+		//the same label names
+		if first := c.Brokers[0]; i > 0 && strings.Join(labelNames(b.Labels), ",") != strings.Join(labelNames(first.Labels), ",") {
+			return fmt.Errorf("brokers[%d] (%s): labels %v differ from the labels %v of brokers[0] (%s), all the brokers must have the same label names",
+				i, b.Name, labelNames(b.Labels), labelNames(first.Labels), first.Name)
+		}
+	}
+
+	return nil
+}
+
+//validate checks the configuration of a single broker
+func (b *brokerConfig) validate() error {
+	if b.URI == "" {
+		return fmt.Errorf("uri is required")
+	}
+
+	if !apiVersions[b.APIVersion] {
+		return fmt.Errorf("unsupported api_version %s, valid values are %v", b.APIVersion, sortedKeys(apiVersions))
+	}
+
+	if !authMethods[b.AuthMethod] {
+		return fmt.Errorf("unsupported auth_method %s, valid values are %v", b.AuthMethod, sortedKeys(authMethods))
+	}
+
+	if (b.Username == "") != (b.Password == "") {
+		return fmt.Errorf("both username and password must be set")
+	}
+
+	if b.Username != "" && b.CredsFile != "" {
+		return fmt.Errorf("username and password can't be set along with creds_file")
+	}
+
+	if b.Timeout < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+
+	if b.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max_concurrent_requests can't be negative")
+	}
+
+	if b.StaleGracePeriod < 0 {
+		return fmt.Errorf("stale_grace_period can't be negative")
+	}
+
+	if b.PollInterval < 0 {
+		return fmt.Errorf("poll_interval can't be negative")
+	}
+
+	if b.Lists.PageSize < 0 || b.Lists.MaxPages < 0 || b.Lists.MaxTopicPrefixes < 0 {
+		return fmt.Errorf("lists: page_size, max_pages and max_topic_prefixes can't be negative")
+	}
+
+	if err := b.Lists.validateClients(); err != nil {
+		return fmt.Errorf("lists: %v", err)
+	}
+
+	for k := range b.Labels {
+		if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+		if k == "node" || k == brokerLabel {
+			return fmt.Errorf("label %q is reserved", k)
+		}
+	}
+
+	for i, rule := range b.RenameRules {
+		for k := range rule.Labels {
+			if _, ok := b.Labels[k]; ok {
+				return fmt.Errorf("label %q is also set by rename_rules[%d]", k, i)
+			}
+		}
+	}
+
+	if _, err := b.tlsConfig(); err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+
+	if _, err := newMetricFilter(b.Filters); err != nil {
+		return fmt.Errorf("filters: %v", err)
+	}
+
+	return nil
+}
+
+//validateClients checks the configuration of the clients collector, whose
+//fields end up in metric names
+func (l *brokerListsConfig) validateClients() error {
+	fields := len(l.ClientFields)
+	if fields == 0 {
+		fields = len(client.DefaultClientFields)
+	}
+
+	if l.TopClients < 0 || l.TopClients*fields > client.MaxTopClients {
+		return fmt.Errorf("top_clients can't be negative, and at most %d clients are exported across the %d client_fields", client.MaxTopClients, fields)
+	}
+
+	for _, f := range l.ClientFields {
+		if !labelName.MatchString(f) {
+			return fmt.Errorf("invalid client field %q", f)
+		}
+		if client.ReservedClientField(f) {
+			return fmt.Errorf("client field %q is reserved", f)
+		}
+	}
+
+	for i := 1; i < len(l.ClientBuckets); i++ {
+		if l.ClientBuckets[i] <= l.ClientBuckets[i-1] {
+			return fmt.Errorf("client_buckets must be in increasing order")
+		}
+	}
+
+	return nil
+}
+
+//tlsConfig returns the TLS configuration of the connections to the broker,
+//nil when not configured
+func (b *brokerConfig) tlsConfig() (*tls.Config, error) {
+	if b.TLS == (brokerTLSConfig{}) {
+		return nil, nil
+	}
+
+	return client.NewTLSConfig(client.TLSConfig(b.TLS))
+}
+
+//sortedKeys returns the sorted keys of a set
+func sortedKeys(set map[string]bool) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
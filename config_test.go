@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Config", func() {
+
+	var dir string
+
+	//helper function to write a configuration file
+	writeConfig := func(content string) string {
+		path := filepath.Join(dir, "config.yml")
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "emq_exporter")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load a valid configuration", func() {
+		path := writeConfig(`
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    api_version: v4
+    creds_file: eu.json
+    timeout: 2s
+    labels:
+      region: eu
+  - name: us
+    uri: http://emqx-us:18083
+    username: admin
+    password: public
+    labels:
+      region: us
+rename_rules:
+  - match: emq_nodes_metrics_packets_(.+)
+    name: emq_packets
+`)
+
+		cfg, err := loadConfig(path)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Brokers).To(HaveLen(2))
+
+		eu := cfg.Brokers[0]
+		Expect(eu.CredsFile).To(Equal(filepath.Join(dir, "eu.json")))
+		Expect(eu.Timeout).To(Equal(2 * time.Second))
+		Expect(eu.Node).To(Equal(defaultNode))
+
+		Expect(eu.RenameRules).To(HaveLen(1))
+
+		us := cfg.Brokers[1]
+		Expect(us.APIVersion).To(Equal(defaultAPIVersion))
+		Expect(us.AuthMethod).To(Equal(defaultAuthMethod))
+	})
+
+	It("should reject rename rules setting a label of the emq flags", func() {
+		b := brokerConfig{
+			URI:         "http://127.0.0.1:18083",
+			Labels:      map[string]string{"env": "prod"},
+			RenameRules: []renameRule{{Match: "emq_nodes_(.+)", Name: "emq_node_$1", Labels: map[string]string{"env": "$1"}}},
+		}
+		b.setDefaults()
+
+		Expect(b.validate()).To(MatchError(`label "env" is also set by rename_rules[0]`))
+	})
+
+	DescribeTable("rejecting invalid configurations",
+		func(content, expected string) {
+			_, err := loadConfig(writeConfig(content))
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(expected))
+		},
+		Entry("unknown fields", `
+brokers:
+  - name: eu
+    url: http://emqx-eu:18083
+`, "field url not found"),
+		Entry("no brokers", `brokers: []`, "no brokers configured"),
+		Entry("missing name", `
+brokers:
+  - uri: http://emqx-eu:18083
+`, "brokers[0]: name is required"),
+		Entry("duplicate names", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+  - name: eu
+    uri: http://emqx-us:18083
+`, `brokers[1]: name "eu" is already used by brokers[0]`),
+		Entry("missing uri", `
+brokers:
+  - name: eu
+`, "brokers[0] (eu): uri is required"),
+		Entry("unknown api version", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    api_version: v6
+`, "brokers[0] (eu): unsupported api_version v6, valid values are [auto v2 v3 v4 v5]"),
+		Entry("unknown auth method", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    auth_method: oauth
+`, "brokers[0] (eu): unsupported auth_method oauth"),
+		Entry("username without password", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    username: admin
+`, "brokers[0] (eu): both username and password must be set"),
+		Entry("inline credentials and a credentials file", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    username: admin
+    password: public
+    creds_file: eu.json
+`, "brokers[0] (eu): username and password can't be set along with creds_file"),
+		Entry("reserved labels", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    labels:
+      broker: eu
+`, `brokers[0] (eu): label "broker" is reserved`),
+		Entry("invalid label names", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    labels:
+      data-center: eu
+`, `brokers[0] (eu): invalid label name "data-center"`),
+		Entry("different label names", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    labels:
+      region: eu
+  - name: us
+    uri: http://emqx-us:18083
+    labels:
+      zone: us
+`, "brokers[1] (us): labels [zone] differ from the labels [region] of brokers[0] (eu)"),
+		Entry("missing tls files", `
+brokers:
+  - name: eu
+    uri: https://emqx-eu:18083
+    tls:
+      ca_file: ca.crt
+`, "brokers[0] (eu): tls: Failed to read CA file"),
+		Entry("invalid filter patterns", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    filters:
+      exclude_metrics: ["emq_(nodes"]
+`, `brokers[0] (eu): filters: invalid exclude_metrics pattern "emq_(nodes"`),
+		Entry("negative list limits", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    lists:
+      subscriptions: true
+      max_pages: -1
+`, "brokers[0] (eu): lists: page_size, max_pages and max_topic_prefixes can't be negative"),
+		Entry("too many top clients", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    lists:
+      clients: true
+      top_clients: 40
+`, "brokers[0] (eu): lists: top_clients can't be negative, and at most 100 clients are exported across the 3 client_fields"),
+		Entry("reserved client fields", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    lists:
+      clients: true
+      client_fields: [mqueue_len, top]
+`, `brokers[0] (eu): lists: client field "top" is reserved`),
+		Entry("unordered client buckets", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    lists:
+      clients: true
+      client_buckets: [10, 1]
+`, "brokers[0] (eu): lists: client_buckets must be in increasing order"),
+		Entry("rename rules without a name", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+rename_rules:
+  - match: emq_nodes_metrics_(.+)
+`, "rename_rules[0]: name is required"),
+		Entry("rename rules setting a broker label", `
+brokers:
+  - name: eu
+    uri: http://emqx-eu:18083
+    labels:
+      type: edge
+rename_rules:
+  - match: emq_nodes_metrics_packets_(.+)
+    name: emq_packets
+    labels:
+      type: $1
+`, `brokers[0] (eu): label "type" is also set by rename_rules[0]`),
+	)
+
+	Describe("reloading the brokers", func() {
+
+		var (
+			s       *ghttp.Server
+			brokers *brokerSet
+		)
+
+		brokerConfigs := func(names ...string) string {
+			content := "brokers:\n"
+			for _, name := range names {
+				content += "  - name: " + name + "\n    uri: " + s.URL() + "\n    username: admin\n    password: public\n"
+			}
+			return content
+		}
+
+		BeforeEach(func() {
+			s = ghttp.NewServer()
+			brokers = &brokerSet{}
+		})
+
+		AfterEach(func() {
+			s.Close()
+		})
+
+		It("should keep the brokers whose configuration didn't change", func() {
+			path := writeConfig(brokerConfigs("eu", "us"))
+			Expect(brokers.load(path)).To(Succeed())
+
+			before := brokers.exporters()
+			Expect(before).To(HaveLen(2))
+
+			writeConfig(brokerConfigs("eu", "asia"))
+			Expect(brokers.load(path)).To(Succeed())
+
+			after := brokers.exporters()
+			Expect(after).To(HaveLen(2))
+			Expect(after[0]).To(BeIdenticalTo(before[0]))
+			Expect(after[1]).ToNot(BeIdenticalTo(before[1]))
+		})
+
+		It("should keep the brokers when the configuration is invalid", func() {
+			path := writeConfig(brokerConfigs("eu"))
+			Expect(brokers.load(path)).To(Succeed())
+
+			writeConfig(`brokers: []`)
+			Expect(brokers.load(path)).ToNot(Succeed())
+
+			Expect(brokers.exporters()).To(HaveLen(1))
+		})
+
+		It("should reload through the reload endpoint", func() {
+			path := writeConfig(brokerConfigs("eu"))
+			Expect(brokers.load(path)).To(Succeed())
+
+			writeConfig(brokerConfigs("eu", "us"))
+
+			handler := reloadHandler(func() error { return brokers.load(path) })
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/-/reload", nil))
+			Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(brokers.exporters()).To(HaveLen(1))
+
+			rec = httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("POST", "/-/reload", nil))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(brokers.exporters()).To(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	usernameEnv = "EMQ_USERNAME"
+	passwordEnv = "EMQ_PASSWORD"
+	//suffix of env vars pointing to a file holding the value, docker secrets style
+	fileEnvSuffix = "_FILE"
+)
+
+//CredentialProvider is a source of emq credentials
+type CredentialProvider interface {
+	//Load returns the credentials, or an error when the source doesn't have them
+	Load() (username, password string, err error)
+	//String describes the source in the logs
+	String() string
+}
+
+//envProvider loads the credentials from env vars
+type envProvider struct{}
+
+func (envProvider) Load() (string, string, error) { return loadFromEnv() }
+func (envProvider) String() string                { return "environment variables" }
+
+//fileProvider loads the credentials from the file at the given path
+type fileProvider string
+
+func (f fileProvider) Load() (string, string, error) { return loadFromFile(string(f)) }
+func (f fileProvider) String() string                { return "file " + string(f) }
+
+//files returns the files named by the _FILE env vars, when they're used
+func (envProvider) files() []string {
+	var res []string
+	for _, name := range []string{usernameEnv, passwordEnv} {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if path, ok := os.LookupEnv(name + fileEnvSuffix); ok {
+			res = append(res, path)
+		}
+	}
+	return res
+}
+
+func (f fileProvider) files() []string { return []string{string(f)} }
+
+//staticProvider provides fixed credentials, set in the configuration file
+type staticProvider client.Credentials
+
+func (s staticProvider) Load() (string, string, error) { return s.Username, s.Password, nil }
+func (s staticProvider) String() string                { return "the configuration file" }
+
+//fileBacked is implemented by the providers reading files, so the files can
+//be watched for changes
+type fileBacked interface {
+	files() []string
+}
+
+//credentialFiles returns the files read by the providers, without duplicates
+func credentialFiles(providers []CredentialProvider) []string {
+	var res []string
+	seen := make(map[string]bool)
+
+	for _, cp := range providers {
+		fb, ok := cp.(fileBacked)
+		if !ok {
+			continue
+		}
+		for _, path := range fb.files() {
+			if !seen[path] {
+				seen[path] = true
+				res = append(res, path)
+			}
+		}
+	}
+
+	return res
+}
+
+//credentialsCache keeps the credentials last loaded from its providers
+type credentialsCache struct {
+	providers []CredentialProvider
+	creds     atomic.Value
+
+	mu sync.Mutex
+	//provider the credentials were last loaded from
+	source string
+}
+
+//reload loads the credentials from the providers, keeping the previous ones
+//on failure. The provider used is reported when it changes
+func (c *credentialsCache) reload() error {
+	u, p, cp, err := loadCreds(c.providers...)
+	if err != nil {
+		return err
+	}
+
+	c.creds.Store(client.Credentials{Username: u, Password: p})
+
+	c.mu.Lock()
+	changed := c.source != cp.String()
+	c.source = cp.String()
+	c.mu.Unlock()
+
+	if !changed {
+		log.Debug().Msgf("Reloaded credentials from %s", cp)
+		return nil
+	}
+
+	if len(c.providers) > 1 {
+		log.Info().Msgf("Using credentials from %s, sources by precedence: %s", cp, joinProviders(c.providers))
+	} else {
+		log.Info().Msgf("Using credentials from %s", cp)
+	}
+
+	return nil
+}
+
+//get returns the cached credentials, empty when none were loaded
+func (c *credentialsCache) get() client.Credentials {
+	creds, _ := c.creds.Load().(client.Credentials)
+	return creds
+}
+
+//findCreds tries to find credentials in the follwing precedence:
+//1. Env vars - EMQ_USERNAME && EMQ_PASSWORD, or EMQ_USERNAME_FILE && EMQ_PASSWORD_FILE
+//2. A file under the specified path
+//returns the found username and password or error
+func findCreds(path string) (u, p string, err error) {
+	log.Debug().Msg("Loading credentails")
+	u, p, _, err = loadCreds(envProvider{}, fileProvider(path))
+	return
+}
+
+//loadCreds returns the credentials of the first provider that has them,
+//along with the provider. The providers after it aren't read
+func loadCreds(providers ...CredentialProvider) (u, p string, from CredentialProvider, err error) {
+	var errs []string
+
+	for _, cp := range providers {
+		u, p, err = cp.Load()
+		if err != nil {
+			log.Debug().Msgf("No credentials in %s: %v", cp, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", cp, err))
+			continue
+		}
+
+		return u, p, cp, nil
+	}
+
+	return "", "", nil, fmt.Errorf("No credentials found in %s", strings.Join(errs, ", "))
+}
+
+//joinProviders describes the providers, in order
+func joinProviders(providers []CredentialProvider) string {
+	names := make([]string, len(providers))
+	for i, cp := range providers {
+		names[i] = cp.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+//loadFromEnv tries to find auth details in env vars
+func loadFromEnv() (u, p string, err error) {
+	log.Debug().Msg("Trying to load credentails from environment")
+
+	if u, err = lookupEnv(usernameEnv); err != nil {
+		return
+	}
+
+	p, err = lookupEnv(passwordEnv)
+
+	return
+}
+
+//lookupEnv returns the value of the env var name, or the content of the
+//file named by name_FILE
+func lookupEnv(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	path, fromFile := os.LookupEnv(name + fileEnvSuffix)
+
+	if ok {
+		if fromFile {
+			log.Warn().Msgf("Both %s and %s%s are set, using %s", name, name, fileEnvSuffix, name)
+		}
+		return v, nil
+	}
+
+	if !fromFile {
+		return "", fmt.Errorf("Can't find %s", name)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Can't read %s%s: %v", name, fileEnvSuffix, err)
+	}
+
+	//secret files usually end with a new line
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+//loadFromFile tries to load auth details from a file, formatted as json,
+//yaml (.yml, .yaml) or env vars (.env)
+func loadFromFile(path string) (u, p string, err error) {
+	log.Debug().Msg("Trying to load credentails from file")
+
+	absPath, ferr := filepath.Abs(path)
+	if ferr != nil {
+		log.Debug().Msg(ferr.Error())
+		err = ferr
+		return
+	}
+
+	f, rerr := ioutil.ReadFile(absPath)
+	if rerr != nil {
+		log.Debug().Msg(rerr.Error())
+		err = rerr
+		return
+	}
+
+	data, perr := parseCreds(absPath, f)
+	if perr != nil {
+		log.Debug().Msg(perr.Error())
+		err = perr
+		return
+	}
+
+	u = data["username"]
+	if u == "" {
+		err = fmt.Errorf("missing username in %s", path)
+	}
+
+	p = data["password"]
+	if p == "" {
+		err = fmt.Errorf("missing password in %s", path)
+	}
+
+	return
+}
+
+//parseCreds parses the content of a credentials file by its extension
+func parseCreds(path string, b []byte) (map[string]string, error) {
+	var data map[string]string
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+	case ".env":
+		env, err := parseDotEnv(b)
+		if err != nil {
+			return nil, fmt.Errorf("%v in %s", err, path)
+		}
+		data = map[string]string{
+			"username": env[usernameEnv],
+			"password": env[passwordEnv],
+		}
+	default:
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+//parseDotEnv parses KEY=value lines, ignoring comments and export keywords
+func parseDotEnv(b []byte) (map[string]string, error) {
+	env := make(map[string]string)
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid line %d", n)
+		}
+
+		v := strings.TrimSpace(kv[1])
+		if len(v) > 1 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+
+		env[strings.TrimSpace(kv[0])] = v
+	}
+
+	return env, s.Err()
+}
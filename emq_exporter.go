@@ -1,16 +1,16 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nuvo/emq_exporter/internal/client"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -20,18 +20,6 @@ const (
 )
 
 var (
-	up = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "up",
-		Help:      "Was the last scrape of EMQ successful",
-	})
-
-	totalScrapes = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "exporter_total_scrapes",
-		Help:      "Current total scrapes.",
-	})
-
 	//GitTag stands for a git tag, populated at build time
 	GitTag string
 	//GitCommit stands for a git commit hash, populated at build time
@@ -40,16 +28,22 @@ var (
 
 //Fetcher knows how to fetch metrics from emq
 type Fetcher interface {
-	Fetch() (map[string]interface{}, error)
+	Fetch(ctx context.Context) ([]client.Sample, error)
 }
 
 //metric is an internal representation of a metric before being processed
 //and sent to prometheus
 type metric struct {
-	kind  prometheus.ValueType
-	value float64
-	name  string
-	help  string
+	kind        prometheus.ValueType
+	value       float64
+	name        string
+	help        string
+	labels      map[string]string
+	constLabels prometheus.Labels
+	//set for histograms, which have no single value
+	histogram *client.HistogramValue
+	//when the metric was last returned by EMQ
+	lastSeen time.Time
 }
 
 // Exporter collects EMQ stats from the given host and exports them using
@@ -57,37 +51,151 @@ type metric struct {
 type Exporter struct {
 	fetcher Fetcher
 	mu      *sync.Mutex
-	metrics []*metric
+	//metrics by name and labels, see metricKey
+	metrics      map[string]*metric
+	up           prometheus.Gauge
+	totalScrapes prometheus.Counter
+	constLabels  prometheus.Labels
+	//node the exporter's own metrics are labeled with, empty when the
+	//nodes are discovered
+	node    string
+	filter  *metricFilter
+	renamer renamer
+	//how long metrics missing from the responses are still exported
+	gracePeriod time.Duration
+	now         func() time.Time
+	//descriptors of the known metrics and of all the metrics seen so far,
+	//by fqName
+	descs map[string]*prometheus.Desc
+	//when set, EMQ is polled in the background and Collect serves the
+	//results of the last poll
+	pollInterval        time.Duration
+	lastPoll            time.Time
+	lastScrapeTimestamp prometheus.Gauge
+	snapshotAge         prometheus.Gauge
+}
+
+// ExporterOption configures optional Exporter behaviour
+type ExporterOption func(*Exporter)
+
+// WithConstLabels adds the given labels to every exported metric
+func WithConstLabels(labels prometheus.Labels) ExporterOption {
+	return func(e *Exporter) {
+		e.constLabels = labels
+	}
+}
+
+// WithNodeLabel adds a node label to the metrics of the exporter itself,
+// such as emq_up, the EMQ metrics have their own
+func WithNodeLabel(node string) ExporterOption {
+	return func(e *Exporter) {
+		e.node = node
+	}
+}
+
+// WithStaleGracePeriod keeps exporting the metrics missing from the EMQ
+// responses for the given duration, as long as the scrapes succeed
+func WithStaleGracePeriod(d time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.gracePeriod = d
+	}
 }
 
 // NewExporter returns an initialized Exporter.
-func NewExporter(fetcher Fetcher) *Exporter {
-	return &Exporter{
+func NewExporter(fetcher Fetcher, opts ...ExporterOption) *Exporter {
+	e := &Exporter{
 		fetcher: fetcher,
 		mu:      &sync.Mutex{},
+		metrics: make(map[string]*metric),
+		descs:   make(map[string]*prometheus.Desc),
+		now:     time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	ownLabels := e.constLabels
+	if e.node != "" {
+		ownLabels = prometheus.Labels{"node": e.node}
+		for k, v := range e.constLabels {
+			ownLabels[k] = v
+		}
+	}
+
+	e.up = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "up",
+		Help:        "Was the last scrape of EMQ successful",
+		ConstLabels: ownLabels,
+	})
+
+	e.totalScrapes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "exporter_total_scrapes",
+		Help:        "Current total scrapes.",
+		ConstLabels: ownLabels,
+	})
+
+	e.lastScrapeTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "last_scrape_timestamp_seconds",
+		Help:        "Time of the last poll of EMQ, in seconds since the epoch",
+		ConstLabels: ownLabels,
+	})
+
+	e.snapshotAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "snapshot_age_seconds",
+		Help:        "Age of the exported metrics, in seconds since the last poll of EMQ",
+		ConstLabels: ownLabels,
+	})
+
+	//the metrics known in advance are described before the first scrape
+	for _, s := range staticSamples {
+		m, ok := e.convert(s)
+		if !ok {
+			continue
+		}
+		m.constLabels = e.constLabels
+		if _, err := newMetric(m); err != nil {
+			log.Error().Msgf("not describing %s: %v", m.name, err)
+			continue
+		}
+		if _, ok := e.descs[m.name]; !ok {
+			e.descs[m.name] = newDesc(m)
+		}
 	}
+
+	return e
 }
 
 // Collect implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	var err error
+	e.collect(context.Background(), ch)
+}
 
-	if err = e.scrape(); err != nil {
-		log.Warn().Msg(err.Error())
+//collect scrapes EMQ until the context is done and sends the metrics to the channel.
+//When polling, the results of the last poll are sent instead
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.pollInterval == 0 {
+		e.record(e.scrape(ctx))
 	}
 
 	//Send the metrics to the channel
 	e.mu.Lock()
 
-	if err != nil {
-		up.Set(0)
-	} else {
-		up.Set(1)
-	}
-	ch <- up
+	ch <- e.up
+	ch <- e.totalScrapes
 
-	totalScrapes.Inc()
-	ch <- totalScrapes
+	if e.pollInterval > 0 {
+		if !e.lastPoll.IsZero() {
+			e.lastScrapeTimestamp.Set(float64(e.lastPoll.UnixNano()) / 1e9)
+			e.snapshotAge.Set(e.now().Sub(e.lastPoll).Seconds())
+		}
+		ch <- e.lastScrapeTimestamp
+		ch <- e.snapshotAge
+	}
 
 	metricList := make([]metric, 0, len(e.metrics))
 	for _, i := range e.metrics {
@@ -96,7 +204,6 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mu.Unlock()
 
 	for _, i := range metricList {
-		i.name = strings.Replace(i.name, ".", "_", -1)
 		m, err := newMetric(i)
 		if err != nil {
 			log.Error().Msg("newMetric: " + err.Error())
@@ -108,71 +215,212 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 }
 
 // Describe implements prometheus.Collector.
+// It sends the descriptors of the metrics known in advance, once renamed and
+// filtered, and of every metric the exporter has emitted so far. EMQ isn't
+// scraped.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- up.Desc()
-	ch <- totalScrapes.Desc()
+	ch <- e.up.Desc()
+	ch <- e.totalScrapes.Desc()
+
+	if e.pollInterval > 0 {
+		ch <- e.lastScrapeTimestamp.Desc()
+		ch <- e.snapshotAge.Desc()
+	}
+
+	e.mu.Lock()
+	descs := make([]*prometheus.Desc, 0, len(e.descs))
+	for _, d := range e.descs {
+		descs = append(descs, d)
+	}
+	e.mu.Unlock()
+
+	for _, d := range descs {
+		ch <- d
+	}
 }
 
-// get the json responses from the targets map, process them and
-// insert them into exporter.metrics array
-func (e *Exporter) scrape() error {
-	data, err := e.fetcher.Fetch()
+//record updates the scrape metrics with the outcome of a scrape
+func (e *Exporter) record(err error) {
 	if err != nil {
-		return err
+		log.Warn().Msg(err.Error())
+		e.up.Set(0)
+	} else {
+		e.up.Set(1)
 	}
 
-	for k, v := range data {
-		fqName := fmt.Sprintf("%s_%s", namespace, k)
-		switch vv := v.(type) {
+	e.totalScrapes.Inc()
+}
+
+// get the json responses from the targets map, process them and
+// insert them into exporter.metrics array
+// partial results are processed even when the fetcher returns an error.
+// Metrics missing from the results are evicted afterwards
+func (e *Exporter) scrape(ctx context.Context) error {
+	start := e.now()
+	data, err := e.fetcher.Fetch(ctx)
+
+	//names of the samples by metric key, to report the samples renamed to
+	//the same metric
+	sources := make(map[string]string, len(data))
+
+	for _, s := range data {
+		m, ok := e.convert(s)
+		if !ok {
+			continue
+		}
+
+		key := metricKey(m.name, m.labels)
+		if src, ok := sources[key]; ok && src != s.Name {
+			log.Error().Msgf("dropping %s, renamed to %s%v like %s", s.Name, m.name, m.labels, src)
+			continue
+		}
+		sources[key] = s.Name
+
+		switch vv := s.Value.(type) {
 		case string:
 			val, err := parseString(vv)
 			if err != nil {
 				break
 			}
-			e.add(fqName, k, val)
+			m.value = val
+			e.add(&m)
 		case float64:
-			e.add(fqName, k, vv)
+			m.value = vv
+			e.add(&m)
+		case client.HistogramValue:
+			m.histogram = &vv
+			e.add(&m)
 		default:
-			log.Debug().Msg(k + " is of type I don't know how to handle")
+			log.Debug().Msg(s.Name + " is of type I don't know how to handle")
 		}
 	}
 
-	return nil
+	//failed scrapes don't keep stale values around
+	deadline := start
+	if err == nil {
+		deadline = start.Add(-e.gracePeriod)
+	}
+	e.evict(deadline)
+
+	return err
 }
 
-//add adds a metric to the exporter.metrics array
-func (e *Exporter) add(fqName, help string, value float64) {
+//convert returns the metric of a sample, without its value, once renamed.
+//false is returned when the filter drops it
+func (e *Exporter) convert(s client.Sample) (metric, bool) {
+	fqName := fmt.Sprintf("%s_%s", namespace, strings.Replace(s.Name, ".", "_", -1))
+
+	fqName, help, labels := e.renamer.rename(fqName, describe(s), s.Labels)
+
+	kind := prometheus.GaugeValue
+	if s.Type == client.Counter {
+		kind = prometheus.CounterValue
+		fqName = counterName(fqName)
+	}
+
+	if !e.filter.keep(fqName, s.Endpoint) {
+		return metric{}, false
+	}
+
+	return metric{kind: kind, name: fqName, help: help, labels: labels}, true
+}
+
+//evict removes the metrics last seen before the deadline
+func (e *Exporter) evict(deadline time.Time) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	//check if the metric with a given fqName exists
-	for _, v := range e.metrics {
-		if strings.Contains(newDesc(*v).String(), fqName) {
-			v.value = value
-			return
+	for k, m := range e.metrics {
+		if m.lastSeen.Before(deadline) {
+			log.Debug().Msgf("evicting stale metric %s%v", m.name, m.labels)
+			delete(e.metrics, k)
 		}
 	}
+}
 
-	//append it to the e.metrics array
-	e.metrics = append(e.metrics, &metric{
-		kind:  prometheus.GaugeValue,
-		name:  fqName,
-		help:  help,
-		value: value,
-	})
+//add adds a metric to the exporter.metrics map, or updates the value of
+//the metric with the same name and labels
+func (e *Exporter) add(m *metric) {
+	key := metricKey(m.name, m.labels)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if v, ok := e.metrics[key]; ok {
+		v.value = m.value
+		v.histogram = m.histogram
+		v.lastSeen = e.now()
+		return
+	}
+
+	m.constLabels = e.constLabels
+	m.lastSeen = e.now()
+
+	//invalid metrics are dropped before their descriptor is kept, Describe
+	//would send it on every scrape otherwise
+	if _, err := newMetric(*m); err != nil {
+		log.Error().Msgf("dropping %s: %v", m.name, err)
+		return
+	}
+
+	//make sure the metric is consistent with the ones already seen
+	desc := newDesc(*m)
+	if d, ok := e.descs[m.name]; ok && d.String() != desc.String() {
+		log.Error().Msgf("dropping %s, conflicts with %s", desc, d)
+		return
+	}
+	e.descs[m.name] = desc
+
+	e.metrics[key] = m
 
 	return
 }
 
 func main() {
 
-	emqAPIVersion := flag.String("emq.api-version", "v3", "The API version used by EMQ. Valid values: [v2, v3, v4]")
+	configFile := flag.String("config.file", "", "Path to a YAML configuration file describing the brokers to scrape. When set, the brokers aren't configured by the emq flags")
+	emqAPIVersion := flag.String("emq.api-version", defaultAPIVersion, "The API version used by EMQ. Valid values: [v2, v3, v4, v5, auto]")
 	emqCreds := flag.String("emq.creds-file", "./auth.json", "Path to json file containing emq credentials")
-	emqNodeName := flag.String("emq.node", "emq@127.0.0.1", "Node name of the emq node to scrape")
+	emqCredsReloadInterval := flag.Duration("emq.creds-reload-interval", 30*time.Second, "How often to check the credentials file for changes, 0 disables it. Credentials are also reloaded on SIGHUP and when EMQ rejects them")
+	emqAuthMethod := flag.String("emq.auth-method", defaultAuthMethod, "How to authenticate to the EMQ api. Valid values: [basic, token]")
+	emqNodeName := flag.String("emq.node", defaultNode, "Node name of the emq node to scrape")
 	emqURI := flag.String("emq.uri", "http://127.0.0.1:18083", "HTTP API address of the EMQ node")
+	emqTLSCAFile := flag.String("emq.tls.ca-file", "", "Path to a CA bundle used to verify the EMQ api server certificate")
+	emqTLSCertFile := flag.String("emq.tls.cert-file", "", "Path to a client certificate used to authenticate to the EMQ api")
+	emqTLSKeyFile := flag.String("emq.tls.key-file", "", "Path to the key of the client certificate")
+	emqTLSServerName := flag.String("emq.tls.server-name", "", "Override the server name used to verify the EMQ api server certificate")
+	emqTLSInsecure := flag.Bool("emq.tls.insecure-skip-verify", false, "Skip the verification of the EMQ api server certificate")
+	emqLabels := labelsFlag{}
+	flag.Var(&emqLabels, "emq.labels", "Comma separated key=value pairs added as labels to all the exported metrics, can be repeated")
+	emqIncludeMetrics := patternsFlag{}
+	flag.Var(&emqIncludeMetrics, "emq.include-metrics", "Regular expression matching the names of the metrics to export, can be repeated. All the metrics are exported by default")
+	emqExcludeMetrics := patternsFlag{}
+	flag.Var(&emqExcludeMetrics, "emq.exclude-metrics", "Regular expression matching the names of the metrics not to export, can be repeated")
+	emqIncludeEndpoints := patternsFlag{}
+	flag.Var(&emqIncludeEndpoints, "emq.include-endpoints", "Regular expression matching the api endpoints whose metrics are exported, can be repeated. All the endpoints are exported by default")
+	emqExcludeEndpoints := patternsFlag{}
+	flag.Var(&emqExcludeEndpoints, "emq.exclude-endpoints", "Regular expression matching the api endpoints whose metrics aren't exported, can be repeated")
+	emqRenameRules := flag.String("emq.rename-rules", "", "Path to a YAML file with the rules renaming the exported metrics")
+	emqListSubscriptions := flag.Bool("emq.lists.subscriptions", false, "Page through the subscriptions of every node, exporting their number by QoS and the number of shared subscriptions")
+	emqListTopics := flag.Bool("emq.lists.topics", false, "Page through the topics of the cluster, exporting their number per node and top level prefix")
+	emqListPageSize := flag.Int("emq.lists.page-size", 1000, "Number of items requested per page of the subscriptions and topics lists")
+	emqListMaxPages := flag.Int("emq.lists.max-pages", 10, "Maximum number of pages fetched per list and scrape, the aggregates of longer lists are partial")
+	emqListMaxTopicPrefixes := flag.Int("emq.lists.max-topic-prefixes", 20, "Maximum number of top level prefixes the topics are counted by, the topics of the other prefixes are counted together")
+	emqListClients := flag.Bool("emq.lists.clients", false, "Page through the clients of the cluster, exporting the top clients and histograms of the client fields")
+	emqListClientFields := flag.String("emq.lists.client-fields", strings.Join(client.DefaultClientFields, ","), "Comma separated numeric fields of the clients to rank and bucket")
+	emqListTopClients := flag.Int("emq.lists.top-clients", 10, fmt.Sprintf("Number of clients exported per client field, at most %d across all the fields", client.MaxTopClients))
+	emqListClientBuckets := flag.String("emq.lists.client-buckets", formatFloats(client.DefaultClientBuckets), "Comma separated upper bounds of the buckets of the client fields histograms")
+	emqDiscoverNodes := flag.Bool("emq.discover-nodes", false, "Discover and scrape all the nodes in the EMQ cluster, adding a node label to the metrics. Overrides emq.node")
 	debug := flag.Bool("debug", false, "sets log level to debug")
 	webListenAddress := flag.String("web.listen-address", ":9540", "Address to listen on for web interface and telemetry")
+	webConfigFile := flag.String("web.config.file", "", "Path to a web configuration file enabling TLS and authentication, in the Prometheus exporter-toolkit format")
 	webMetricsPath := flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics")
+	webTimeoutOffset := flag.Duration("web.timeout-offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout requested by Prometheus")
+	emqStaleGracePeriod := flag.Duration("emq.stale-grace-period", 0, "How long to keep exporting the metrics missing from the EMQ responses. By default every scrape only exports the metrics EMQ returned")
+	emqPollInterval := flag.Duration("emq.poll-interval", 0, "Poll EMQ in the background at this interval and serve the results of the last poll, instead of scraping EMQ on every request. Disabled by default")
+	emqConcurrency := flag.Int("emq.max-concurrent-requests", 4, "Maximum number of concurrent requests made to the EMQ api during a scrape")
+	webProbePath := flag.String("web.probe-path", "/probe", "Path under which to expose the multi-target probe endpoint")
+	probeAllowedTargets := flag.String("probe.allowed-targets", "", "Comma separated EMQ api addresses the probes send the default credentials to, besides the configured brokers. Other targets are probed without credentials")
 
 	flag.Parse()
 
@@ -186,33 +434,155 @@ func main() {
 
 	log.Logger = log.With().Caller().Logger()
 
-	log.Info().Msg("Loading authentication credentials")
+	log.Info().Msg("Starting emq_exporter")
+	log.Info().Msgf("Version %s (git-%s)", GitTag, GitCommit)
 
-	username, password, err := findCreds(*emqCreds)
+	//the emq flags describe the broker scraped when there's no configuration
+	//file, and configure the probes
+	flagBroker := brokerConfig{
+		URI:                   *emqURI,
+		Node:                  *emqNodeName,
+		DiscoverNodes:         *emqDiscoverNodes,
+		APIVersion:            *emqAPIVersion,
+		AuthMethod:            *emqAuthMethod,
+		MaxConcurrentRequests: *emqConcurrency,
+		StaleGracePeriod:      *emqStaleGracePeriod,
+		PollInterval:          *emqPollInterval,
+		TLS: brokerTLSConfig{
+			CAFile:             *emqTLSCAFile,
+			CertFile:           *emqTLSCertFile,
+			KeyFile:            *emqTLSKeyFile,
+			ServerName:         *emqTLSServerName,
+			InsecureSkipVerify: *emqTLSInsecure,
+		},
+		Lists: brokerListsConfig{
+			Subscriptions:    *emqListSubscriptions,
+			Topics:           *emqListTopics,
+			PageSize:         *emqListPageSize,
+			MaxPages:         *emqListMaxPages,
+			MaxTopicPrefixes: *emqListMaxTopicPrefixes,
+			Clients:          *emqListClients,
+			ClientFields:     splitList(*emqListClientFields),
+			TopClients:       *emqListTopClients,
+		},
+		Labels: emqLabels,
+		Filters: filterConfig{
+			IncludeMetrics:   emqIncludeMetrics,
+			ExcludeMetrics:   emqExcludeMetrics,
+			IncludeEndpoints: emqIncludeEndpoints,
+			ExcludeEndpoints: emqExcludeEndpoints,
+		},
+	}
+
+	buckets, err := parseFloats(*emqListClientBuckets)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load credentials:")
+		log.Fatal().Err(err).Msg("invalid emq.lists.client-buckets flag")
 	}
+	flagBroker.Lists.ClientBuckets = buckets
 
-	log.Info().Msg("Starting emq_exporter")
-	log.Info().Msgf("Version %s (git-%s)", GitTag, GitCommit)
+	if *emqRenameRules != "" {
+		rules, err := loadRenameRules(*emqRenameRules)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load the rename rules")
+		}
+		flagBroker.RenameRules = rules
+	}
+
+	if err := flagBroker.validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid emq flags")
+	}
 
-	switch *emqAPIVersion {
-	case "v2":
+	if *emqAPIVersion == "v2" {
 		log.Warn().Msg("v2 api version is deprecated and will be removed in future versions")
-	case "v3", "v4":
-	default:
-		log.Fatal().Err(errors.New("unsupported api version")).Msg("unsupported api version: " + *emqAPIVersion)
 	}
 
-	c := client.NewClient(*emqURI, *emqNodeName, *emqAPIVersion, username, password)
+	log.Info().Msg("Loading authentication credentials")
 
-	exporter := NewExporter(c)
+	//credentials of the brokers that don't set their own, and of the probes
+	defaultCreds := &credentialsCache{providers: []CredentialProvider{envProvider{}, fileProvider(*emqCreds)}}
 
-	prometheus.MustRegister(exporter)
+	if err := defaultCreds.reload(); err != nil {
+		if *configFile == "" {
+			log.Fatal().Err(err).Msg("Failed to load credentials:")
+		}
+		log.Warn().Err(err).Msg("Failed to load the default credentials")
+	}
+
+	brokers := &brokerSet{defaults: defaultCreds, credsReloadInterval: *emqCredsReloadInterval}
+	reloadConfig := func() error { return nil }
+
+	if *configFile == "" {
+		b, err := newBroker(flagBroker, defaultCreds, *emqCredsReloadInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create the emq client")
+		}
+		brokers.set([]*broker{b})
+	} else {
+		reloadConfig = func() error { return brokers.load(*configFile) }
+		if err := reloadConfig(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load the configuration")
+		}
+	}
+
+	reloadCreds := func() {
+		if err := defaultCreds.reload(); err != nil {
+			log.Warn().Err(err).Msg("Failed to reload the default credentials")
+		}
+		brokers.reloadCredentials()
+	}
+
+	if *emqCredsReloadInterval > 0 {
+		for _, path := range credentialFiles(defaultCreds.providers) {
+			go watchFile(context.Background(), path, *emqCredsReloadInterval, reloadCreds)
+		}
+	}
+
+	go onSignal(context.Background(), func() {
+		reloadCreds()
+		if err := reloadConfig(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload the configuration")
+		}
+	})
+
+	//probes scrape a single node, discovery is only used for the brokers
+	probeOpts, err := flagBroker.clientOptions()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure the probes")
+	}
+
+	probeFilter, err := newMetricFilter(flagBroker.Filters)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure the probes")
+	}
+
+	probeRenamer, err := newRenamer(flagBroker.RenameRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure the probes")
+	}
+
+	//credentials are only sent to known targets, any address can be probed
+	allowedTargets := make(map[string]bool)
+	for _, t := range splitList(*probeAllowedTargets) {
+		allowedTargets[targetKey(t)] = true
+	}
+
+	probeCreds := func(target string) (client.Credentials, bool) {
+		if creds, ok := brokers.credentials(target); ok {
+			return creds, true
+		}
+		if allowedTargets[targetKey(target)] {
+			return defaultCreds.get(), true
+		}
+		return client.Credentials{}, false
+	}
 
 	log.Info().Msg("Listening on " + *webListenAddress)
 
-	http.Handle(*webMetricsPath, promhttp.Handler())
+	http.Handle(*webMetricsPath, metricsHandler(brokers.exporters, *webTimeoutOffset))
+	http.Handle(*webProbePath, probeHandler(*emqNodeName, *emqAPIVersion, probeCreds, *webTimeoutOffset, probeOpts, WithConstLabels(prometheus.Labels(emqLabels)), WithFilter(probeFilter), WithRenamer(probeRenamer)))
+	if *configFile != "" {
+		http.Handle("/-/reload", reloadHandler(reloadConfig))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>EMQ Exporter</title></head>
@@ -223,7 +593,9 @@ func main() {
              </html>`))
 	})
 
-	if err := http.ListenAndServe(*webListenAddress, nil); err != nil {
+	server := &http.Server{Addr: *webListenAddress}
+
+	if err := listenAndServe(server, *webConfigFile); err != nil {
 		log.Fatal().Err(err).Msg("startup failed")
 	}
 
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"os"
+	"sync"
+	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/nuvo/emq_exporter/internal/client"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var _ = Describe("Utility Functions", func() {
@@ -65,6 +74,29 @@ var _ = Describe("Utility Functions", func() {
 				Expect(u).Should(Equal("admin"))
 				Expect(p).Should(Equal("secret"))
 			})
+
+			It("should read the values of _FILE env vars from files", func() {
+				os.Setenv(usernameEnv, "admin")
+				os.Setenv(passwordEnv+fileEnvSuffix, "testdata/password.txt")
+				defer os.Unsetenv(passwordEnv + fileEnvSuffix)
+
+				u, p, err := loadFromEnv()
+
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(u).Should(Equal("admin"))
+				Expect(p).Should(Equal("secret"))
+			})
+
+			It("should fail when a _FILE env var points to a missing file", func() {
+				os.Setenv(usernameEnv+fileEnvSuffix, "testdata/nothere.txt")
+				defer os.Unsetenv(usernameEnv + fileEnvSuffix)
+
+				_, _, err := loadFromEnv()
+
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("Can't read EMQ_USERNAME_FILE"))
+			})
 		})
 
 		Context("loading from file", func() {
@@ -116,6 +148,22 @@ var _ = Describe("Utility Functions", func() {
 				Expect(u).Should(Equal("admin"))
 				Expect(p).Should(Equal("public"))
 			})
+
+			It("should load yaml files", func() {
+				u, p, err := loadFromFile("testdata/auth.yml")
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(u).Should(Equal("admin"))
+				Expect(p).Should(Equal("public"))
+			})
+
+			It("should load .env files", func() {
+				u, p, err := loadFromFile("testdata/auth.env")
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(u).Should(Equal("admin"))
+				Expect(p).Should(Equal("public"))
+			})
 		})
 
 		Context("finding credentails", func() {
@@ -150,6 +198,80 @@ var _ = Describe("Utility Functions", func() {
 				Expect(p).Should(Equal("public"))
 			})
 
+			It("should report all the providers when none has credentials", func() {
+				u, p, err := findCreds("testdata/nothere.json")
+
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(HavePrefix("No credentials found in environment variables: Can't find EMQ_USERNAME, file testdata/nothere.json:"))
+
+				Expect(u).Should(BeEmpty())
+				Expect(p).Should(BeEmpty())
+			})
+
+			It("should not read the providers after the one used", func() {
+				shadowed := &countingProvider{}
+
+				u, p, cp, err := loadCreds(staticProvider{Username: "admin", Password: "public"}, shadowed)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(u).Should(Equal("admin"))
+				Expect(p).Should(Equal("public"))
+				Expect(cp.String()).Should(Equal("the configuration file"))
+				Expect(shadowed.loads).Should(BeZero())
+			})
+
+			It("should list the files the providers read", func() {
+				os.Setenv(usernameEnv, "admin")
+				os.Setenv(passwordEnv+fileEnvSuffix, "testdata/password.txt")
+				defer os.Unsetenv(passwordEnv + fileEnvSuffix)
+
+				files := credentialFiles([]CredentialProvider{envProvider{}, fileProvider("testdata/authfull.json"), staticProvider{}, fileProvider("testdata/authfull.json")})
+
+				Expect(files).Should(Equal([]string{"testdata/password.txt", "testdata/authfull.json"}))
+			})
+		})
+	})
+
+	Context("parsing labels", func() {
+
+		It("should parse comma separated pairs", func() {
+			l := labelsFlag{}
+
+			Expect(l.Set("env=prod,dc=eu-1")).To(Succeed())
+			Expect(l.Set("team=iot")).To(Succeed())
+
+			Expect(l).To(Equal(labelsFlag{"env": "prod", "dc": "eu-1", "team": "iot"}))
+			Expect(l.String()).To(Equal("dc=eu-1,env=prod,team=iot"))
+		})
+
+		It("should fail on invalid pairs", func() {
+			l := labelsFlag{}
+
+			Expect(l.Set("env")).ToNot(Succeed())
+			Expect(l.Set("=prod")).ToNot(Succeed())
+		})
+
+		It("should not allow overriding the node label", func() {
+			l := labelsFlag{}
+
+			Expect(l.Set("node=emqx")).ToNot(Succeed())
+		})
+	})
+
+	Context("parsing lists", func() {
+
+		It("should parse comma separated numbers", func() {
+			fs, err := parseFloats("0, 1,2.5,,1e3")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fs).To(Equal([]float64{0, 1, 2.5, 1000}))
+			Expect(formatFloats(fs)).To(Equal("0,1,2.5,1000"))
+		})
+
+		It("should fail on invalid numbers", func() {
+			_, err := parseFloats("1,ten")
+
+			Expect(err).To(MatchError(`invalid number "ten"`))
 		})
 	})
 
@@ -198,6 +320,21 @@ var _ = Describe("Utility Functions", func() {
 			Expect(pm.Desc().String()).To(Equal("Desc{fqName: \"emq_node_memory_current\", help: \"Current memory usage\", constLabels: {}, variableLabels: []}"))
 		})
 
+		It("should return a labeled metric", func() {
+			m := metric{
+				kind:   prometheus.GaugeValue,
+				name:   "emq_node_memory_current",
+				help:   "Current memory usage",
+				value:  1.5533,
+				labels: map[string]string{"node": "emqx@127.0.0.1"},
+			}
+
+			pm, err := newMetric(m)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pm.Desc().String()).To(Equal("Desc{fqName: \"emq_node_memory_current\", help: \"Current memory usage\", constLabels: {}, variableLabels: [node]}"))
+		})
+
 		It("should fail when the fqName isn't valid", func() {
 			m := metric{
 				kind:  prometheus.GaugeValue,
@@ -226,8 +363,8 @@ type mockFetcher struct{}
 //ensure mockFetcher implements Fetcher
 var _ Fetcher = &mockFetcher{}
 
-func (m *mockFetcher) Fetch() (data map[string]interface{}, err error) {
-	data = map[string]interface{}{
+func (m *mockFetcher) Fetch(ctx context.Context) (data []client.Sample, err error) {
+	values := map[string]interface{}{
 		"nodes_metrics_messages_qos1_sent":      randFloat(),
 		"nodes_metrics_packets_pubrel_missed":   randFloat(),
 		"nodes_metrics_packets_puback_sent":     randFloat(),
@@ -263,9 +400,65 @@ func (m *mockFetcher) Fetch() (data map[string]interface{}, err error) {
 		"nodes_version":                         "v3.0.1",
 	}
 
+	for k, v := range values {
+		data = append(data, client.Sample{Name: k, Value: v, Labels: map[string]string{"node": "emqx@172.17.0.2"}})
+	}
+
 	return
 }
 
+//static fetcher for testing, always returns the same samples
+type staticFetcher []client.Sample
+
+func (f staticFetcher) Fetch(ctx context.Context) ([]client.Sample, error) {
+	return f, nil
+}
+
+//counting fetcher for testing, counts the calls to Fetch
+type countingFetcher struct {
+	staticFetcher
+	calls int
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context) ([]client.Sample, error) {
+	f.calls++
+	return f.staticFetcher.Fetch(ctx)
+}
+
+//counting provider for testing, counts the calls to Load
+type countingProvider struct {
+	loads int
+}
+
+func (p *countingProvider) Load() (string, string, error) {
+	p.loads++
+	return "other", "secret", nil
+}
+
+func (p *countingProvider) String() string { return "counting provider" }
+
+//fetcher func for testing, calls the function to fetch
+type fetcherFunc func(ctx context.Context) ([]client.Sample, error)
+
+func (f fetcherFunc) Fetch(ctx context.Context) ([]client.Sample, error) {
+	return f(ctx)
+}
+
+//helper function to gather the metric families of a collector by name
+func gather(c prometheus.Collector) map[string]*dto.MetricFamily {
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+
+	mfs, err := r.Gather()
+	Expect(err).ToNot(HaveOccurred())
+
+	res := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
 var _ = Describe("Exporter", func() {
 
 	var (
@@ -301,4 +494,494 @@ var _ = Describe("Exporter", func() {
 
 		close(done)
 	}, timeout)
+
+	It("should keep metrics of different nodes apart", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx@10.0.0.1"}},
+			{Name: "nodes_connections", Value: float64(2), Labels: map[string]string{"node": "emqx@10.0.0.2"}},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs).To(HaveKey("emq_nodes_connections"))
+		Expect(mfs["emq_nodes_connections"].GetMetric()).To(HaveLen(2))
+	})
+
+	It("should export counters with a _total suffix", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_metrics_messages_received", Value: float64(10), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_stats_connections_count", Value: float64(3), Type: client.Gauge, Labels: map[string]string{"node": "emqx"}},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs).To(HaveKey("emq_nodes_metrics_messages_received_total"))
+		Expect(mfs["emq_nodes_metrics_messages_received_total"].GetType()).To(Equal(dto.MetricType_COUNTER))
+		Expect(mfs).To(HaveKey("emq_nodes_stats_connections_count"))
+		Expect(mfs["emq_nodes_stats_connections_count"].GetType()).To(Equal(dto.MetricType_GAUGE))
+	})
+
+	It("should describe known metrics", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_metrics_bytes_received", Endpoint: "nodes_metrics", Value: float64(10), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_stats_connections.count", Endpoint: "nodes_stats", Value: float64(3), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_something_new", Endpoint: "nodes", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			{Name: "subscriptions_shared", Endpoint: "subscriptions", Value: float64(2), Labels: map[string]string{"node": "emqx"}},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs["emq_nodes_metrics_bytes_received_total"].GetHelp()).To(Equal("Number of bytes received (bytes)"))
+		Expect(mfs["emq_nodes_stats_connections_count"].GetHelp()).To(Equal("Number of connections"))
+		Expect(mfs["emq_nodes_something_new"].GetHelp()).To(Equal("EMQ metric nodes_something_new"))
+		Expect(mfs["emq_subscriptions_shared"].GetHelp()).To(Equal("Number of shared subscriptions of the node listed by the api"))
+	})
+
+	It("should export histograms", func() {
+		e = NewExporter(staticFetcher{
+			{
+				Name:     "clients_mqueue_len",
+				Endpoint: "clients",
+				Value:    client.HistogramValue{Count: 2, Sum: 703, Buckets: map[float64]uint64{10: 1, 1000: 2}},
+				Type:     client.Histogram,
+				Labels:   map[string]string{"node": "emqx"},
+			},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs).To(HaveKey("emq_clients_mqueue_len"))
+		Expect(mfs["emq_clients_mqueue_len"].GetType()).To(Equal(dto.MetricType_HISTOGRAM))
+		Expect(mfs["emq_clients_mqueue_len"].GetHelp()).To(Equal("Distribution of the message queue lengths of the clients of the node"))
+
+		h := mfs["emq_clients_mqueue_len"].GetMetric()[0].GetHistogram()
+		Expect(h.GetSampleCount()).To(Equal(uint64(2)))
+		Expect(h.GetSampleSum()).To(Equal(703.0))
+		Expect(h.GetBucket()).To(HaveLen(2))
+	})
+
+	It("should describe the known and the emitted metrics", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_load1", Value: "1.2", Labels: map[string]string{"node": "emqx"}},
+		})
+
+		describe := func() []string {
+			ch := make(chan *prometheus.Desc, 100)
+			e.Describe(ch)
+			close(ch)
+
+			var descs []string
+			for d := range ch {
+				descs = append(descs, d.String())
+			}
+			return descs
+		}
+
+		descs := describe()
+		Expect(descs).To(ContainElement(ContainSubstring(`fqName: "emq_scrape_success"`)))
+		Expect(descs).To(ContainElement(ContainSubstring(`fqName: "emq_subscriptions_by_qos"`)))
+		Expect(descs).ToNot(ContainElement(ContainSubstring(`fqName: "emq_nodes_connections"`)))
+
+		gather(e)
+
+		descs = describe()
+		Expect(descs).To(ContainElement(ContainSubstring(`fqName: "emq_nodes_connections"`)))
+		Expect(descs).To(ContainElement(ContainSubstring(`fqName: "emq_nodes_load1"`)))
+	})
+
+	It("should describe the known metrics once renamed and filtered", func() {
+		filter, err := newMetricFilter(filterConfig{ExcludeEndpoints: []string{"topics"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		r, err := newRenamer([]renameRule{{Match: "emq_subscriptions_(.*)", Name: "emq_subs_$1"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		e = NewExporter(f, WithFilter(filter), WithRenamer(r))
+
+		ch := make(chan *prometheus.Desc, 100)
+		e.Describe(ch)
+		close(ch)
+
+		var descs []string
+		for d := range ch {
+			descs = append(descs, d.String())
+		}
+
+		Expect(descs).To(ContainElement(ContainSubstring(`fqName: "emq_subs_listed"`)))
+		Expect(descs).ToNot(ContainElement(ContainSubstring(`fqName: "emq_subscriptions_listed"`)))
+		Expect(descs).ToNot(ContainElement(ContainSubstring(`fqName: "emq_topics_listed"`)))
+	})
+
+	It("should not scrape EMQ in Describe", func() {
+		cf := &countingFetcher{staticFetcher: staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+		}}
+		e = NewExporter(cf)
+
+		ch := make(chan *prometheus.Desc, 100)
+		e.Describe(ch)
+		Expect(cf.calls).To(Equal(0))
+
+		gather(e)
+		Expect(cf.calls).To(Equal(1))
+
+		gather(e)
+		Expect(cf.calls).To(Equal(2))
+	})
+
+	It("should not mix up metrics whose names share a prefix", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_stats_connections_count", Value: float64(3), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_stats_connections_count_max", Value: float64(8), Labels: map[string]string{"node": "emqx"}},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs["emq_nodes_stats_connections_count"].GetMetric()[0].GetGauge().GetValue()).To(Equal(3.0))
+		Expect(mfs["emq_nodes_stats_connections_count_max"].GetMetric()[0].GetGauge().GetValue()).To(Equal(8.0))
+	})
+
+	It("should drop metrics conflicting with known descriptors", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx", "protocol": "mqtt"}},
+		})
+
+		mfs := gather(e)
+
+		Expect(mfs["emq_nodes_connections"].GetMetric()).To(HaveLen(1))
+	})
+
+	It("should only export the metrics selected by the filter", func() {
+		filter, err := newMetricFilter(filterConfig{
+			IncludeMetrics:   []string{"emq_nodes_.*", "emq_scrape_.*"},
+			ExcludeMetrics:   []string{".*_bytes_.*"},
+			ExcludeEndpoints: []string{"nodes_stats"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_metrics_bytes_received", Endpoint: "nodes_metrics", Value: float64(10), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_metrics_messages_received", Endpoint: "nodes_metrics", Value: float64(10), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_stats_connections.count", Endpoint: "nodes_stats", Value: float64(3), Labels: map[string]string{"node": "emqx"}},
+			{Name: "listeners_current_conns", Endpoint: "listeners", Value: float64(3), Labels: map[string]string{"node": "emqx"}},
+			{Name: "scrape_success", Value: float64(1), Labels: map[string]string{"node": "emqx", "endpoint": "nodes_stats"}},
+		}, WithFilter(filter))
+
+		mfs := gather(e)
+
+		Expect(mfs).To(HaveKey("emq_nodes_metrics_messages_received_total"))
+		Expect(mfs).To(HaveKey("emq_scrape_success"))
+		Expect(mfs).To(HaveKey("emq_up"))
+		Expect(mfs).ToNot(HaveKey("emq_nodes_metrics_bytes_received_total"))
+		Expect(mfs).ToNot(HaveKey("emq_nodes_stats_connections_count"))
+		Expect(mfs).ToNot(HaveKey("emq_listeners_current_conns"))
+	})
+
+	It("should rename metrics and move parts of their names to labels", func() {
+		r, err := newRenamer([]renameRule{
+			{
+				Match:  `emq_nodes_metrics_packets_(?P<type>[a-z]+)_(?P<direction>received|sent)`,
+				Name:   "emq_packets",
+				Help:   "Number of MQTT packets",
+				Labels: map[string]string{"type": "${type}", "direction": "$direction"},
+			},
+			{Match: "emq_nodes_(.+)", Name: "emq_node_$1"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		filter, err := newMetricFilter(filterConfig{ExcludeMetrics: []string{"emq_node_load1"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_metrics_packets_publish_received", Endpoint: "nodes_metrics", Value: float64(10), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_metrics_packets_subscribe_received", Endpoint: "nodes_metrics", Value: float64(3), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_metrics_packets_publish_sent", Endpoint: "nodes_metrics", Value: float64(7), Type: client.Counter, Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_connections", Endpoint: "nodes", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_load1", Endpoint: "nodes", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+		}, WithRenamer(r), WithFilter(filter))
+
+		mfs := gather(e)
+
+		Expect(mfs).To(HaveKey("emq_packets_total"))
+		Expect(mfs["emq_packets_total"].GetHelp()).To(Equal("Number of MQTT packets"))
+		Expect(mfs["emq_packets_total"].GetType()).To(Equal(dto.MetricType_COUNTER))
+		Expect(mfs["emq_packets_total"].GetMetric()).To(HaveLen(3))
+		Expect(mfs["emq_packets_total"].GetMetric()[0].GetLabel()).To(ConsistOf(
+			&dto.LabelPair{Name: proto.String("direction"), Value: proto.String("received")},
+			&dto.LabelPair{Name: proto.String("node"), Value: proto.String("emqx")},
+			&dto.LabelPair{Name: proto.String("type"), Value: proto.String("publish")},
+		))
+		Expect(mfs).To(HaveKey("emq_node_connections"))
+		Expect(mfs).ToNot(HaveKey("emq_nodes_connections"))
+		Expect(mfs).ToNot(HaveKey("emq_node_load1"))
+	})
+
+	It("should load rename rules from a file", func() {
+		rules, err := loadRenameRules("testdata/rename.yml")
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rules).To(HaveLen(1))
+		Expect(rules[0].Labels).To(HaveKeyWithValue("direction", "$2"))
+
+		_, err = loadRenameRules("testdata/auth.yml")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject invalid rename rules", func() {
+		_, err := newRenamer([]renameRule{{Match: "emq_(.+", Name: "emq_x"}})
+		Expect(err).To(MatchError(ContainSubstring(`rename_rules[0]: invalid match pattern "emq_(.+"`)))
+
+		_, err = newRenamer([]renameRule{{Match: "emq_.+", Name: "emq-x"}})
+		Expect(err).To(MatchError(`rename_rules[0]: invalid metric name "emq-x"`))
+
+		_, err = newRenamer([]renameRule{{Match: "emq_.+", Name: "emq_x", Labels: map[string]string{"node": "x"}}})
+		Expect(err).To(MatchError(`rename_rules[0]: label "node" is reserved`))
+
+		_, err = newRenamer([]renameRule{{Match: "emq_listeners_(.+)", Name: "emq_listener", Labels: map[string]string{"protocol": "$1"}}})
+		Expect(err).To(MatchError(`rename_rules[0]: label "protocol" is reserved`))
+	})
+
+	It("should report the metrics renamed to the same metric", func() {
+		r, err := newRenamer([]renameRule{{Match: "emq_nodes_stats_(.+)_(count|max)", Name: "emq_$1"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_stats_connections_count", Endpoint: "nodes_stats", Value: float64(3), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_stats_connections_max", Endpoint: "nodes_stats", Value: float64(8), Labels: map[string]string{"node": "emqx"}},
+		}, WithRenamer(r))
+
+		mfs := gather(e)
+
+		Expect(mfs["emq_connections"].GetMetric()).To(HaveLen(1))
+		Expect(mfs["emq_connections"].GetMetric()[0].GetGauge().GetValue()).To(Equal(3.0))
+	})
+
+	It("should not create a filter without patterns", func() {
+		filter, err := newMetricFilter(filterConfig{})
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filter).To(BeNil())
+		Expect(filter.keep("emq_nodes_connections", "nodes")).To(BeTrue())
+	})
+
+	Describe("evicting stale metrics", func() {
+
+		var (
+			now       time.Time
+			responses [][]client.Sample
+			fetchErr  error
+		)
+
+		connections := client.Sample{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}}
+		load := client.Sample{Name: "nodes_load1", Value: float64(1), Labels: map[string]string{"node": "emqx"}}
+
+		//scrape once, moving the clock forward
+		scrape := func() map[string]*dto.MetricFamily {
+			now = now.Add(15 * time.Second)
+			return gather(e)
+		}
+
+		BeforeEach(func() {
+			now = time.Unix(0, 0)
+			responses = nil
+			fetchErr = nil
+		})
+
+		newExporter := func(opts ...ExporterOption) {
+			e = NewExporter(fetcherFunc(func(ctx context.Context) ([]client.Sample, error) {
+				res := responses[0]
+				if len(responses) > 1 {
+					responses = responses[1:]
+				}
+				return res, fetchErr
+			}), opts...)
+			e.now = func() time.Time { return now }
+		}
+
+		It("should drop the metrics missing from the response", func() {
+			newExporter()
+			responses = [][]client.Sample{{connections, load}, {connections}}
+
+			Expect(scrape()).To(HaveKey("emq_nodes_load1"))
+
+			mfs := scrape()
+			Expect(mfs).To(HaveKey("emq_nodes_connections"))
+			Expect(mfs).ToNot(HaveKey("emq_nodes_load1"))
+		})
+
+		It("should keep the missing metrics during the grace period", func() {
+			newExporter(WithStaleGracePeriod(20 * time.Second))
+			responses = [][]client.Sample{{connections, load}, {connections}}
+
+			Expect(scrape()).To(HaveKey("emq_nodes_load1"))
+			Expect(scrape()).To(HaveKey("emq_nodes_load1"))
+			Expect(scrape()).ToNot(HaveKey("emq_nodes_load1"))
+		})
+
+		It("should not export stale metrics when the scrape fails", func() {
+			newExporter(WithStaleGracePeriod(time.Minute))
+			responses = [][]client.Sample{{connections, load}, nil}
+
+			Expect(scrape()).To(HaveKey("emq_nodes_load1"))
+
+			fetchErr = errors.New("connection refused")
+			mfs := scrape()
+
+			Expect(mfs).ToNot(HaveKey("emq_nodes_connections"))
+			Expect(mfs).ToNot(HaveKey("emq_nodes_load1"))
+			Expect(mfs["emq_up"].GetMetric()[0].GetGauge().GetValue()).To(Equal(0.0))
+		})
+	})
+
+	Describe("polling", func() {
+
+		var cf *countingFetcher
+
+		BeforeEach(func() {
+			cf = &countingFetcher{staticFetcher: staticFetcher{
+				{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			}}
+			e = NewExporter(cf, WithPollInterval(time.Minute))
+		})
+
+		It("should serve the results of the last poll", func() {
+			now := time.Unix(100, 0)
+			e.now = func() time.Time { return now }
+
+			e.poll(context.Background())
+			now = now.Add(5 * time.Second)
+
+			gather(e)
+			mfs := gather(e)
+
+			Expect(cf.calls).To(Equal(1))
+			Expect(mfs).To(HaveKey("emq_nodes_connections"))
+			Expect(mfs["emq_up"].GetMetric()[0].GetGauge().GetValue()).To(Equal(1.0))
+			Expect(mfs["emq_exporter_total_scrapes"].GetMetric()[0].GetCounter().GetValue()).To(Equal(1.0))
+			Expect(mfs["emq_last_scrape_timestamp_seconds"].GetMetric()[0].GetGauge().GetValue()).To(Equal(100.0))
+			Expect(mfs["emq_snapshot_age_seconds"].GetMetric()[0].GetGauge().GetValue()).To(Equal(5.0))
+		})
+
+		It("should not scrape EMQ before the first poll", func() {
+			mfs := gather(e)
+
+			Expect(cf.calls).To(Equal(0))
+			Expect(mfs).ToNot(HaveKey("emq_nodes_connections"))
+			Expect(mfs["emq_up"].GetMetric()[0].GetGauge().GetValue()).To(Equal(0.0))
+		})
+
+		It("should poll until the context is done", func() {
+			var mu sync.Mutex
+			calls := 0
+			e = NewExporter(fetcherFunc(func(ctx context.Context) ([]client.Sample, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				return nil, nil
+			}), WithPollInterval(10*time.Millisecond))
+
+			count := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return calls
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				e.Poll(ctx)
+				close(done)
+			}()
+
+			Eventually(count).Should(BeNumerically(">=", 3))
+			cancel()
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	It("should add the const labels to all the metrics", func() {
+		e = NewExporter(f, WithConstLabels(prometheus.Labels{"env": "prod"}))
+
+		for name, mf := range gather(e) {
+			for _, m := range mf.GetMetric() {
+				Expect(m.GetLabel()).To(ContainElement(&dto.LabelPair{
+					Name:  proto.String("env"),
+					Value: proto.String("prod"),
+				}), name)
+			}
+		}
+	})
+
+	It("should label all the metrics with the node", func() {
+		e = NewExporter(staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx@10.0.0.1"}},
+		}, WithNodeLabel("emqx@10.0.0.1"), WithPollInterval(time.Minute), WithConstLabels(prometheus.Labels{"env": "prod"}))
+		e.poll(context.Background())
+
+		mfs := gather(e)
+
+		for _, name := range []string{"emq_up", "emq_exporter_total_scrapes", "emq_last_scrape_timestamp_seconds", "emq_snapshot_age_seconds", "emq_nodes_connections"} {
+			Expect(mfs).To(HaveKey(name))
+			Expect(mfs[name].GetMetric()[0].GetLabel()).To(ContainElement(&dto.LabelPair{
+				Name:  proto.String("node"),
+				Value: proto.String("emqx@10.0.0.1"),
+			}), name)
+		}
+	})
 })
+
+//samples returns n samples of a node, half counters and half gauges, like
+//a large EMQ response
+func samples(n int) staticFetcher {
+	res := make(staticFetcher, 0, n)
+	for i := 0; i < n; i++ {
+		s := client.Sample{
+			Name:     fmt.Sprintf("nodes_metrics_key_%d", i),
+			Endpoint: "nodes_metrics",
+			Value:    float64(i),
+			Type:     client.Counter,
+			Labels:   map[string]string{"node": "emqx@127.0.0.1"},
+		}
+		if i%2 == 0 {
+			s.Name = fmt.Sprintf("nodes_stats_key_%d", i)
+			s.Endpoint = "nodes_stats"
+			s.Type = client.Gauge
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func BenchmarkScrape(b *testing.B) {
+	e := NewExporter(samples(500))
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := e.scrape(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	e := NewExporter(samples(500))
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	defer close(ch)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		e.Collect(ch)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+//filterConfig configures the metrics exported, by their final name and by
+//the endpoint they were fetched from. The patterns are anchored regular
+//expressions
+type filterConfig struct {
+	IncludeMetrics   []string `yaml:"include_metrics"`
+	ExcludeMetrics   []string `yaml:"exclude_metrics"`
+	IncludeEndpoints []string `yaml:"include_endpoints"`
+	ExcludeEndpoints []string `yaml:"exclude_endpoints"`
+}
+
+//metricFilter selects the metrics to export. A metric is exported when it
+//matches one of the include patterns, if any, and none of the exclude ones
+type metricFilter struct {
+	includeMetrics   []*regexp.Regexp
+	excludeMetrics   []*regexp.Regexp
+	includeEndpoints []*regexp.Regexp
+	excludeEndpoints []*regexp.Regexp
+}
+
+// WithFilter exports only the metrics selected by the filter
+func WithFilter(f *metricFilter) ExporterOption {
+	return func(e *Exporter) {
+		e.filter = f
+	}
+}
+
+//newMetricFilter compiles the patterns of the configuration, nil is
+//returned when there are none
+func newMetricFilter(cfg filterConfig) (*metricFilter, error) {
+	f := &metricFilter{}
+
+	for _, p := range []struct {
+		name     string
+		patterns []string
+		res      *[]*regexp.Regexp
+	}{
+		{"include_metrics", cfg.IncludeMetrics, &f.includeMetrics},
+		{"exclude_metrics", cfg.ExcludeMetrics, &f.excludeMetrics},
+		{"include_endpoints", cfg.IncludeEndpoints, &f.includeEndpoints},
+		{"exclude_endpoints", cfg.ExcludeEndpoints, &f.excludeEndpoints},
+	} {
+		for _, pattern := range p.patterns {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pattern %q: %v", p.name, pattern, err)
+			}
+			*p.res = append(*p.res, re)
+		}
+	}
+
+	if len(f.includeMetrics)+len(f.excludeMetrics)+len(f.includeEndpoints)+len(f.excludeEndpoints) == 0 {
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+//keep checks if the metric named fqName, fetched from endpoint, should be
+//exported. Metrics of the exporter itself have no endpoint and are only
+//filtered by name
+func (f *metricFilter) keep(fqName, endpoint string) bool {
+	if f == nil {
+		return true
+	}
+
+	if !selected(fqName, f.includeMetrics, f.excludeMetrics) {
+		return false
+	}
+
+	return endpoint == "" || selected(endpoint, f.includeEndpoints, f.excludeEndpoints)
+}
+
+//selected checks s against the include and exclude patterns
+func selected(s string, include, exclude []*regexp.Regexp) bool {
+	if len(include) > 0 && !matchAny(s, include) {
+		return false
+	}
+
+	return !matchAny(s, exclude)
+}
+
+//matchAny checks if s matches any of the patterns
+func matchAny(s string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+//scrapeCollector collects the metrics of an exporter for a single scrape,
+//aborting when the scrape's context is done
+type scrapeCollector struct {
+	*Exporter
+	ctx context.Context
+}
+
+// Collect implements prometheus.Collector.
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(c.ctx, ch)
+}
+
+//scrapeTimeout returns the time a scrape may take, based on the timeout
+//Prometheus sets in the request headers minus the given offset.
+//0 means there is no timeout
+func scrapeTimeout(r *http.Request, offset time.Duration) time.Duration {
+	v := r.Header.Get(scrapeTimeoutHeader)
+	if v == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Debug().Msgf("can't parse %s header %q: %v", scrapeTimeoutHeader, v, err)
+		return 0
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - offset
+	if timeout <= 0 {
+		//keep the timeout requested by Prometheus when the offset is too large
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+
+	return timeout
+}
+
+//serveScrape serves the metrics of the exporters and of the given gatherers.
+//The scrape is cancelled when the request is, and limited to the timeout
+//requested by Prometheus
+func serveScrape(w http.ResponseWriter, r *http.Request, exporters []*Exporter, offset time.Duration, gatherers ...prometheus.Gatherer) {
+	ctx := r.Context()
+
+	if timeout := scrapeTimeout(r, offset); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	registry := prometheus.NewRegistry()
+
+	for _, e := range exporters {
+		if err := registry.Register(scrapeCollector{e, ctx}); err != nil {
+			log.Error().Err(err).Msg("Failed to register the exporter")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	gatherers = append(gatherers, registry)
+
+	promhttp.HandlerFor(prometheus.Gatherers(gatherers), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+//metricsHandler returns a handler serving the metrics of the current
+//exporters along with the ones of the default registry
+func metricsHandler(exporters func() []*Exporter, offset time.Duration) http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveScrape(w, r, exporters(), offset, prometheus.DefaultGatherer)
+		}),
+	)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//deadline recording fetcher for testing
+type deadlineFetcher struct {
+	deadline time.Time
+	ok       bool
+}
+
+func (f *deadlineFetcher) Fetch(ctx context.Context) ([]client.Sample, error) {
+	f.deadline, f.ok = ctx.Deadline()
+	return nil, nil
+}
+
+var _ = Describe("Handler", func() {
+
+	DescribeTable("computing the scrape timeout",
+		func(header string, offset, expected time.Duration) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if header != "" {
+				r.Header.Set(scrapeTimeoutHeader, header)
+			}
+
+			Expect(scrapeTimeout(r, offset)).To(Equal(expected))
+		},
+		Entry("no header", "", 500*time.Millisecond, time.Duration(0)),
+		Entry("invalid header", "ten", 500*time.Millisecond, time.Duration(0)),
+		Entry("with an offset", "10", 500*time.Millisecond, 9500*time.Millisecond),
+		Entry("fractional seconds", "2.5", time.Duration(0), 2500*time.Millisecond),
+		Entry("offset larger than the timeout", "0.2", 500*time.Millisecond, 200*time.Millisecond),
+	)
+
+	It("should pass the scrape deadline to the fetcher", func() {
+		f := &deadlineFetcher{}
+		e := NewExporter(f)
+
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set(scrapeTimeoutHeader, "10")
+
+		serveScrape(rec, r, []*Exporter{e}, time.Second)
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(f.ok).To(BeTrue())
+		Expect(f.deadline).To(BeTemporally("~", time.Now().Add(9*time.Second), time.Second))
+	})
+
+	It("should serve the metrics of several exporters", func() {
+		f := staticFetcher{
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+		}
+
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+
+		serveScrape(rec, r, []*Exporter{
+			NewExporter(f, WithConstLabels(prometheus.Labels{brokerLabel: "eu"})),
+			NewExporter(f, WithConstLabels(prometheus.Labels{brokerLabel: "us"})),
+		}, 0)
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring(`emq_nodes_connections{broker="eu",node="emqx"} 1`))
+		Expect(rec.Body.String()).To(ContainSubstring(`emq_nodes_connections{broker="us",node="emqx"} 1`))
+	})
+
+	It("should keep serving the metrics after dropping an invalid one", func() {
+		e := NewExporter(staticFetcher{
+			{Name: "nodes_stats_foo-bar", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+			{Name: "nodes_connections", Value: float64(1), Labels: map[string]string{"node": "emqx"}},
+		})
+
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			serveScrape(rec, httptest.NewRequest("GET", "/metrics", nil), []*Exporter{e}, 0)
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring(`emq_nodes_connections{node="emqx"} 1`))
+			Expect(rec.Body.String()).ToNot(ContainSubstring("foo-bar"))
+		}
+	})
+})
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+//endpoint issuing bearer tokens, EMQX 5 only
+const loginPath = "/api/v5/login"
+
+//Authenticator authenticates the requests made to the emq api
+type Authenticator interface {
+	//Authenticate sets the credentials of the request
+	Authenticate(ctx context.Context, req *http.Request) error
+	//Invalidate is called when the api rejected the credentials of req,
+	//it returns true when retrying with fresh credentials may succeed
+	Invalidate(req *http.Request) bool
+}
+
+//WithAuthenticator sets the authenticator of the client, the default is
+//basic auth with the client's current credentials
+func WithAuthenticator(a Authenticator) Option {
+	return func(c *Client) {
+		c.auth = a
+	}
+}
+
+//WithTokenAuth makes the client authenticate with bearer tokens, obtained by
+//logging in to the api with the client's current credentials. A new token
+//is obtained when the api rejects the current one
+func WithTokenAuth() Option {
+	return func(c *Client) {
+		c.auth = &tokenAuth{c: c}
+	}
+}
+
+//basicAuth authenticates with basic auth, the default. EMQX 5 api keys and
+//v4 applications are sent this way too, their id as username and their
+//secret as password
+type basicAuth struct {
+	creds func() Credentials
+}
+
+//Authenticate implements Authenticator, requests are sent without
+//credentials when the client has none
+func (a *basicAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	creds := a.creds()
+	if creds == (Credentials{}) {
+		return nil
+	}
+	req.SetBasicAuth(creds.Username, creds.Password)
+	return nil
+}
+
+//Invalidate implements Authenticator, static credentials can't be refreshed
+func (a *basicAuth) Invalidate(req *http.Request) bool {
+	return false
+}
+
+//tokenAuth authenticates with a bearer token issued by the api
+type tokenAuth struct {
+	c     *Client
+	mu    sync.Mutex
+	token string
+}
+
+//Authenticate implements Authenticator, there's no login when the client
+//has no credentials
+func (a *tokenAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	if a.c.Credentials() == (Credentials{}) {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == "" {
+		token, err := a.login(ctx)
+		if err != nil {
+			return err
+		}
+		a.token = token
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	return nil
+}
+
+//Invalidate implements Authenticator, dropping the token of req unless it was
+//already replaced by a concurrent request
+func (a *tokenAuth) Invalidate(req *http.Request) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if req.Header.Get("Authorization") == "Bearer "+a.token {
+		a.token = ""
+	}
+
+	return true
+}
+
+//login obtains a new token from the api
+func (a *tokenAuth) login(ctx context.Context) (string, error) {
+	creds := a.c.Credentials()
+
+	body, err := json.Marshal(map[string]string{
+		"username": creds.Username,
+		"password": creds.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.c.url(loginPath), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create login request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	log.Debug().Msg("Logging in to " + req.URL.String())
+
+	res, err := a.c.hc.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to login: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Login rejected by %s, got %d", req.URL, res.StatusCode)
+	}
+
+	lr := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+		return "", fmt.Errorf("Error in json decoder %v", err)
+	}
+
+	if lr.Token == "" {
+		return "", fmt.Errorf("No token in the login response of %s", req.URL)
+	}
+
+	return lr.Token, nil
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+//header authenticator for testing, sets a fixed header
+type headerAuth struct {
+	name, value string
+}
+
+func (a headerAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	req.Header.Set(a.name, a.value)
+	return nil
+}
+
+func (a headerAuth) Invalidate(req *http.Request) bool {
+	return false
+}
+
+var _ = Describe("Authenticators", func() {
+
+	var (
+		s    *ghttp.Server
+		path = "/api/v5/nodes/%s/stats"
+	)
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("should authenticate with an api key", func() {
+		s.RouteToHandler("GET", "/api/v5/nodes/emqx/stats", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("key", "secret"),
+			ghttp.RespondWith(200, loadData("v5/stats.json")),
+		))
+
+		c := NewClient(s.URL(), "emqx", "v5", "key", "secret")
+
+		_, err := c.get(context.Background(), path)
+
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should authenticate with a custom authenticator", func() {
+		s.RouteToHandler("GET", "/api/v5/nodes/emqx/stats", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("X-Api-Token", "secret"),
+			ghttp.RespondWith(200, loadData("v5/stats.json")),
+		))
+
+		c := NewClient(s.URL(), "emqx", "v5", "", "", WithAuthenticator(headerAuth{"X-Api-Token", "secret"}))
+
+		_, err := c.get(context.Background(), path)
+
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("Bearer tokens", func() {
+
+		var (
+			c      *Client
+			logins int
+			valid  string
+		)
+
+		BeforeEach(func() {
+			logins, valid = 0, ""
+
+			s.RouteToHandler("POST", loginPath, ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"username": "admin", "password": "public"}`),
+				func(w http.ResponseWriter, r *http.Request) {
+					logins++
+					valid = fmt.Sprintf("token-%d", logins)
+					w.Write([]byte(`{"token": "` + valid + `", "version": "5.1.0"}`))
+				},
+			))
+
+			s.RouteToHandler("GET", "/api/v5/nodes/emqx/stats", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer "+valid {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write(loadData("v5/stats.json"))
+			})
+
+			c = NewClient(s.URL(), "emqx", "v5", "admin", "public", WithTokenAuth())
+		})
+
+		It("should login and reuse the token", func() {
+			for i := 0; i < 2; i++ {
+				data, err := c.get(context.Background(), path)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(data).To(HaveKeyWithValue("connections.count", float64(10)))
+			}
+
+			Expect(logins).To(Equal(1))
+		})
+
+		It("should login again when the token is rejected", func() {
+			_, err := c.get(context.Background(), path)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			//the token expires
+			valid = "expired"
+
+			_, err = c.get(context.Background(), path)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(logins).To(Equal(2))
+		})
+
+		It("should fail when the login is rejected", func() {
+			s.RouteToHandler("POST", loginPath, ghttp.RespondWith(http.StatusUnauthorized, `{"code": "BAD_USERNAME_OR_PWD"}`))
+
+			data, err := c.get(context.Background(), path)
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Login rejected"))
+			Expect(data).To(BeNil())
+		})
+	})
+})
@@ -1,16 +1,23 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-const timeout = 5 * time.Second
+const (
+	timeout            = 5 * time.Second
+	defaultConcurrency = 4
+)
 
 var (
 	targetsV2 = map[string]string{
@@ -30,95 +37,495 @@ var (
 		"nodes_stats":   "/api/v4/nodes/%s/stats/",
 		"nodes":         "/api/v4/nodes/%s",
 	}
+	//scraping endpoints for EMQX 5, responses aren't wrapped in an envelope
+	targetsV5 = map[string]string{
+		"nodes_metrics":   "/api/v5/nodes/%s/metrics",
+		"nodes_stats":     "/api/v5/nodes/%s/stats",
+		"nodes":           "/api/v5/nodes/%s",
+		"monitor_current": "/api/v5/monitor_current/nodes/%s",
+	}
+	//scraping endpoints by api version
+	targets = map[string]map[string]string{
+		"v2": targetsV2,
+		"v3": targetsV3,
+		"v4": targetsV4,
+		"v5": targetsV5,
+	}
+	//endpoints listing the listeners of a node
+	listenerTargets = map[string]string{
+		"v3": "/api/v3/nodes/%s/listeners",
+		"v4": "/api/v4/nodes/%s/listeners",
+	}
+	//listener fields exported as metrics
+	listenerFields = []string{"current_conns", "max_conns", "acceptors"}
+	//endpoints listing all the nodes in the cluster, used for discovery
+	nodeLists = map[string]string{
+		"v2": "/api/v2/management/nodes",
+		"v3": "/api/v3/nodes/",
+		"v4": "/api/v4/nodes",
+		"v5": "/api/v5/nodes",
+	}
 )
 
 type emqResponse struct {
-	Code   float64                `json:"code,omitempty"`
-	Result map[string]interface{} `json:"result,omitempty"` //api v2 json key
-	Data   map[string]interface{} `json:"data,omitempty"`   //api v3 json key
+	Code   float64         `json:"code,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"` //api v2 json key
+	Data   json.RawMessage `json:"data,omitempty"`   //api v3 json key
+	Meta   json.RawMessage `json:"meta,omitempty"`   //pagination of lists
+}
+
+//Sample is a single value fetched from the emq api
+type Sample struct {
+	Name     string
+	Endpoint string
+	Labels   map[string]string
+	Value    interface{}
+	Type     ValueType
 }
 
 //Client manages communication with emq api
 type Client struct {
-	hc         *http.Client
-	host       string
-	node       string
-	apiVersion string
-	targets    map[string]string
-	username   string
-	password   string
+	hc          *http.Client
+	host        string
+	node        string
+	apiVersion  string
+	discover    bool
+	concurrency int
+	auth        Authenticator
+	lists       ListConfig
+	//current Credentials, replaced when reloaded
+	creds atomic.Value
+	load  CredentialsLoader
+
+	//state of the api version detection, see detect.go
+	mu       sync.Mutex
+	detected string
+	releases map[string]string
+	failures int
+}
+
+//Option configures optional Client behaviour
+type Option func(*Client)
+
+//WithNodeDiscovery makes the client scrape every node in the cluster
+//instead of the single node it was created with, the node names are taken
+//from the api's node list
+func WithNodeDiscovery() Option {
+	return func(c *Client) {
+		c.discover = true
+	}
+}
+
+//WithConcurrency sets the maximum number of concurrent requests made to the
+//emq api during a single fetch
+func WithConcurrency(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.concurrency = n
+		}
+	}
+}
+
+//WithTimeout sets the timeout of a single request to the emq api
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.hc.Timeout = d
+		}
+	}
 }
 
 //NewClient returns a new emq client
-func NewClient(host, node, apiVersion, username, password string) *Client {
+func NewClient(host, node, apiVersion, username, password string, opts ...Option) *Client {
 
 	c := &Client{
-		hc:         &http.Client{Timeout: timeout},
-		host:       host,
-		node:       node,
-		apiVersion: apiVersion,
-		username:   username,
-		password:   password,
+		hc:          &http.Client{Timeout: timeout},
+		host:        host,
+		node:        node,
+		apiVersion:  apiVersion,
+		concurrency: defaultConcurrency,
 	}
 
-	switch apiVersion {
-	case "v2":
-		c.targets = targetsV2
-	case "v3":
-		c.targets = targetsV3
-	case "v4":
-		c.targets = targetsV4
+	c.creds.Store(Credentials{Username: username, Password: password})
+	c.auth = &basicAuth{creds: c.Credentials}
+
+	for _, opt := range opts {
+		opt(c)
 	}
 
 	return c
 }
 
+//job fetches the samples of a single endpoint of a single node
+type job struct {
+	node     string
+	endpoint string
+	fetch    func(ctx context.Context) ([]Sample, error)
+}
+
+//result is the outcome of running a job
+type result struct {
+	index   int
+	samples []Sample
+	err     error
+}
+
+//run fetches the samples of the job, adding samples describing the outcome
+//of the fetch. Samples of failed jobs are dropped
+func (j job) run(ctx context.Context) ([]Sample, error) {
+	start := time.Now()
+
+	data, err := j.fetch(ctx)
+	if err != nil {
+		data = nil
+	}
+
+	return j.outcome(data, time.Since(start), err), err
+}
+
+//outcome adds samples describing the outcome of the job to its data
+func (j job) outcome(data []Sample, d time.Duration, err error) []Sample {
+	success := float64(1)
+	if err != nil {
+		success = 0
+	}
+
+	labels := map[string]string{"node": j.node, "endpoint": j.endpoint}
+
+	return append(data,
+		Sample{Name: "scrape_success", Labels: labels, Value: success},
+		Sample{Name: "scrape_duration_seconds", Labels: labels, Value: d.Seconds()},
+	)
+}
+
 //Fetch gets all the metrics from the emq api listed in the targets map
 //implements emq_exporter.Fetcher
-func (c *Client) Fetch() (map[string]interface{}, error) {
+//The endpoints are fetched concurrently, endpoints that don't respond before
+//the context is done are considered failed.
+//A failing endpoint doesn't fail the whole fetch, an error is returned only
+//when nothing could be fetched
+func (c *Client) Fetch(ctx context.Context) ([]Sample, error) {
+	version, err := c.resolveVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	data := make(map[string]interface{})
+	data, err := c.fetch(ctx, version)
+	c.record(err)
+
+	return data, err
+}
 
-	for name, path := range c.targets {
+//fetch gets all the metrics of the given api version
+func (c *Client) fetch(ctx context.Context, version string) ([]Sample, error) {
 
-		res, err := c.get(path)
-		if err != nil {
+	nodes := []string{c.node}
+
+	if c.discover {
+		var err error
+		if nodes, err = c.discoverNodes(ctx); err != nil {
 			return nil, err
 		}
+	}
+
+	var (
+		data    []Sample
+		failed  int
+		lastErr error
+	)
+
+	jobs := c.jobs(version, nodes)
+
+	for _, r := range c.runJobs(ctx, jobs) {
+		if r.err != nil {
+			j := jobs[r.index]
+			log.Warn().Msgf("Failed to fetch %s of %s: %v", j.endpoint, j.node, r.err)
+			failed++
+			lastErr = r.err
+		}
+		data = append(data, r.samples...)
+	}
+
+	data = append(data, c.buildInfo(version, nodes)...)
+
+	if len(jobs) > 0 && failed == len(jobs) {
+		return data, fmt.Errorf("Failed to fetch all endpoints: %v", lastErr)
+	}
+
+	return data, nil
+}
+
+//runJobs runs the jobs on a bounded pool of workers and returns their results,
+//in the order of the jobs. Jobs that haven't finished when the context is
+//done are given up on, cancelling their outstanding requests
+func (c *Client) runJobs(ctx context.Context, jobs []job) []result {
+	start := time.Now()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	queue := make(chan int)
+	go func() {
+		defer close(queue)
+		for i := range jobs {
+			select {
+			case queue <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	//buffered so workers of abandoned jobs never block
+	ch := make(chan result, len(jobs))
+	for w := 0; w < c.concurrency && w < len(jobs); w++ {
+		go func() {
+			for i := range queue {
+				samples, err := jobs[i].run(ctx)
+				ch <- result{index: i, samples: samples, err: err}
+			}
+		}()
+	}
+
+	results := make([]result, len(jobs))
+	finished := make([]bool, len(jobs))
+
+	for n := 0; n < len(jobs); n++ {
+		select {
+		case r := <-ch:
+			results[r.index] = r
+			finished[r.index] = true
+		case <-ctx.Done():
+			d := time.Since(start)
+			for i, ok := range finished {
+				if ok {
+					continue
+				}
+				err := fmt.Errorf("Gave up after %v: %v", d, ctx.Err())
+				results[i] = result{index: i, samples: jobs[i].outcome(nil, d, err), err: err}
+			}
+			return results
+		}
+	}
+
+	return results
+}
+
+//jobs returns the jobs fetching all the endpoints of the given api version
+//from the given nodes
+func (c *Client) jobs(version string, nodes []string) []job {
+	var jobs []job
+
+	for _, node := range nodes {
+		node := node
+
+		//in a fixed order, so the endpoints are fetched the same way on
+		//every scrape
+		for _, name := range targetNames(version) {
+			name, path := name, targets[version][name]
+			jobs = append(jobs, job{
+				node:     node,
+				endpoint: name,
+				fetch:    func(ctx context.Context) ([]Sample, error) { return c.fetchTarget(ctx, version, node, name, path) },
+			})
+		}
+
+		if path, ok := listenerTargets[version]; ok {
+			jobs = append(jobs, job{
+				node:     node,
+				endpoint: "listeners",
+				fetch:    func(ctx context.Context) ([]Sample, error) { return c.fetchListeners(ctx, node, path) },
+			})
+		}
+	}
+
+	return append(jobs, c.listJobs(version, nodes)...)
+}
+
+//targetNames returns the sorted names of the endpoints of an api version
+func targetNames(version string) []string {
+	names := make([]string, 0, len(targets[version]))
+	for name := range targets[version] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//fetchTarget gets the metrics of a single endpoint of the given node
+func (c *Client) fetchTarget(ctx context.Context, version, node, name, path string) ([]Sample, error) {
+	res, err := c.getNode(ctx, path, node)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]Sample, 0, len(res))
+
+	for k, v := range res {
+		data = append(data, Sample{
+			Name:     fmt.Sprintf("%s_%s", name, strings.Replace(k, "/", "_", -1)),
+			Endpoint: name,
+			Labels:   map[string]string{"node": node},
+			Value:    v,
+			Type:     classify(version, name, k),
+		})
+	}
+
+	return data, nil
+}
+
+//fetchListeners gets the per listener metrics of the given node
+func (c *Client) fetchListeners(ctx context.Context, node, path string) ([]Sample, error) {
+	var list []map[string]interface{}
+
+	if err := c.do(ctx, fmt.Sprintf(path, node), &list); err != nil {
+		return nil, err
+	}
+
+	var data []Sample
+
+	for _, l := range list {
+		labels := map[string]string{
+			"node":      node,
+			"protocol":  fmt.Sprint(l["protocol"]),
+			"listen_on": fmt.Sprint(l["listen_on"]),
+		}
 
-		for k, v := range res {
-			mName := fmt.Sprintf("%s_%s", name, strings.Replace(k, "/", "_", -1))
-			data[mName] = v
+		for _, f := range listenerFields {
+			v, ok := l[f]
+			if !ok {
+				continue
+			}
+			data = append(data, Sample{
+				Name:     "listeners_" + f,
+				Endpoint: "listeners",
+				Labels:   labels,
+				Value:    v,
+			})
 		}
 	}
 
 	return data, nil
 }
 
+//discoverNodes returns the names of all the nodes in the cluster
+func (c *Client) discoverNodes(ctx context.Context) ([]string, error) {
+	var list []map[string]interface{}
+
+	path := nodeLists[c.version()]
+
+	if err := c.do(ctx, path, &list); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(list))
+	for _, n := range list {
+		name, ok := nodeName(n)
+		if !ok {
+			log.Debug().Msgf("can't find the node name in %v", n)
+			continue
+		}
+		nodes = append(nodes, name)
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("No nodes discovered from %s", path)
+	}
+
+	log.Debug().Msgf("Discovered nodes %v", nodes)
+
+	return nodes, nil
+}
+
+//nodeName returns the name of a node listed by the api
+func nodeName(n map[string]interface{}) (string, bool) {
+	//v4 and v5 name the field node, v2 and v3 use name
+	name, ok := n["node"].(string)
+	if !ok {
+		name, ok = n["name"].(string)
+	}
+	return name, ok
+}
+
 //set the host name for the client (mostly for testing purposes)
 func (c *Client) setHost(host string) {
 	c.host = host
 }
 
-//get preforms an http GET call to the provided path and returns the response
-func (c *Client) get(path string) (map[string]interface{}, error) {
+//get preforms an http GET call to the provided path for the client's node
+//and returns the response
+func (c *Client) get(ctx context.Context, path string) (map[string]interface{}, error) {
+	return c.getNode(ctx, path, c.node)
+}
+
+//getNode preforms an http GET call to the provided path for the given node
+//and returns the response
+func (c *Client) getNode(ctx context.Context, path, node string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
 
-	req, err := c.newRequest(path)
-	if err != nil {
+	if err := c.do(ctx, fmt.Sprintf(path, node), &data); err != nil {
 		return nil, err
 	}
 
-	er := &emqResponse{}
-	data := make(map[string]interface{})
+	return data, nil
+}
+
+//do preforms an http GET call to the provided path and decodes the
+//response data into v
+func (c *Client) do(ctx context.Context, path string, v interface{}) error {
+	return c.request(ctx, c.version(), path, v)
+}
+
+//request preforms an http GET call to the provided path and decodes the
+//response data of the given api version into v
+func (c *Client) request(ctx context.Context, version, path string, v interface{}) error {
+
+	er, err := c.response(ctx, version, path)
+	if err != nil {
+		return err
+	}
+
+	data := er.Data
+	if version == "v2" {
+		data = er.Result
+	}
+
+	//Print the returned response data for debuging
+	log.Debug().Msgf("%s", data)
 
-	res, err := c.hc.Do(req)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error in json decoder %v", err)
+	}
+
+	return nil
+}
+
+//response preforms an http GET call to the provided path and returns the
+//response envelope of the given api version. v5 responses aren't wrapped,
+//the whole body is returned as the data
+func (c *Client) response(ctx context.Context, version, path string) (*emqResponse, error) {
+
+	res, err := c.send(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get metrics: %v", err)
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Received status code not ok %s, got %d", req.URL, res.StatusCode)
+		return nil, fmt.Errorf("Received status code not ok %s, got %d", res.Request.URL, res.StatusCode)
+	}
+
+	er := &emqResponse{}
+
+	if version == "v5" {
+		if err := json.NewDecoder(res.Body).Decode(&er.Data); err != nil {
+			return nil, fmt.Errorf("Error in json decoder %v", err)
+		}
+		return er, nil
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(er); err != nil {
@@ -129,37 +536,68 @@ func (c *Client) get(path string) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("Recvied code != 0 from EMQ %f", er.Code)
 	}
 
-	//Print the returned response data for debuging
-	log.Debug().Msgf("%#v", *er)
+	return er, nil
+}
 
-	if c.apiVersion == "v2" {
-		data = er.Result
-	} else {
-		data = er.Data
-	}
+//send preforms an http GET call to the provided path, retrying once when
+//the api rejects the credentials and they could be refreshed
+func (c *Client) send(ctx context.Context, path string) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		creds := c.Credentials()
 
-	return data, nil
-}
+		req, err := c.newRequest(ctx, path)
+		if err != nil {
+			return nil, err
+		}
 
-//newRequest creates a new http request, setting the relevant headers
-func (c *Client) newRequest(path string) (req *http.Request, err error) {
+		res, err := c.hc.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get metrics: %v", err)
+		}
+
+		if res.StatusCode != http.StatusUnauthorized || retried {
+			return res, nil
+		}
+
+		//evaluate both, reloaded credentials invalidate cached tokens too
+		reloaded := c.reloadRejected(creds)
+		if !c.auth.Invalidate(req) && !reloaded {
+			return res, nil
+		}
 
-	u := c.host + fmt.Sprintf(path, c.node)
+		res.Body.Close()
+		log.Debug().Msgf("Credentials rejected by %s, retrying", req.URL)
+	}
+}
+
+//url returns the full url of the provided path
+func (c *Client) url(path string) string {
+	u := c.host + path
 
 	if !strings.Contains(u, "://") {
 		u = fmt.Sprintf("http://%s", u)
 	}
 
+	return u
+}
+
+//newRequest creates a new http request, setting the relevant headers
+func (c *Client) newRequest(ctx context.Context, path string) (req *http.Request, err error) {
+
+	u := c.url(path)
+
 	log.Debug().Msg("Fetching from " + u)
 
-	req, err = http.NewRequest(http.MethodGet, u, nil)
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		log.Debug().Msg("Failed to create http request: " + err.Error())
 		return req, fmt.Errorf("Failed to create http request: %v", err)
 	}
 
 	//set request headers
-	req.SetBasicAuth(c.username, c.password)
+	if err := c.auth.Authenticate(ctx, req); err != nil {
+		return nil, fmt.Errorf("Failed to authenticate: %v", err)
+	}
 	req.Header.Set("Accept", "application/json")
 
 	return
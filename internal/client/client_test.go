@@ -1,12 +1,15 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	. "github.com/onsi/gomega/gstruct"
 )
 
 //helper function to load json data from the testdata folder
@@ -68,13 +71,309 @@ var _ = Describe("Client", func() {
 				}),
 				ghttp.RespondWith(200, loadData("node.json")),
 			))
+
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx/listeners", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("admin", "public"),
+				ghttp.VerifyHeader(http.Header{
+					"Accept": []string{"application/json"},
+				}),
+				ghttp.RespondWith(200, loadData("listeners.json")),
+			))
 		})
 
 		It("should succeed fetching the metrics", func() {
-			res, err := c.Fetch()
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_version",
+				Endpoint: "nodes",
+				Value:    "v3.0.1",
+				Labels:   map[string]string{"node": "emqx"},
+			}))
+		})
+
+		It("should fetch the listener metrics", func() {
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:     "listeners_current_conns",
+				Endpoint: "listeners",
+				Value:    float64(12),
+				Labels:   map[string]string{"node": "emqx", "protocol": "mqtt:tcp", "listen_on": "0.0.0.0:1883"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "listeners_acceptors",
+				Endpoint: "listeners",
+				Value:    float64(16),
+				Labels:   map[string]string{"node": "emqx", "protocol": "mqtt:ssl", "listen_on": "8883"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "listeners_max_conns",
+				Endpoint: "listeners",
+				Value:    float64(102400),
+				Labels:   map[string]string{"node": "emqx", "protocol": "mqtt:ws", "listen_on": "8083"},
+			}))
+		})
+	})
+
+	Context("Partial fetching", func() {
+
+		BeforeEach(func() {
+			s.AllowUnhandledRequests = true
+			s.UnhandledRequestStatusCode = http.StatusInternalServerError
+
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx", ghttp.RespondWith(200, loadData("node.json")))
+		})
+
+		It("should return the results of the healthy endpoints", func() {
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_version",
+				Endpoint: "nodes",
+				Value:    "v3.0.1",
+				Labels:   map[string]string{"node": "emqx"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:   "scrape_success",
+				Value:  float64(1),
+				Labels: map[string]string{"node": "emqx", "endpoint": "nodes"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:   "scrape_success",
+				Value:  float64(0),
+				Labels: map[string]string{"node": "emqx", "endpoint": "nodes_stats"},
+			}))
+			Expect(res).To(ContainElement(MatchFields(IgnoreExtras, Fields{
+				"Name":   Equal("scrape_duration_seconds"),
+				"Labels": Equal(map[string]string{"node": "emqx", "endpoint": "nodes_stats"}),
+			})))
+		})
+
+		It("should fail when all the endpoints fail", func() {
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx", ghttp.RespondWith(500, nil))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Failed to fetch all endpoints"))
+			Expect(res).ToNot(ContainElement(MatchFields(IgnoreExtras, Fields{
+				"Name":  Equal("scrape_success"),
+				"Value": Equal(float64(1)),
+			})))
+		})
+	})
+
+	Context("Concurrent fetching", func() {
+
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx/metrics/", ghttp.RespondWith(200, loadData("metrics.json")))
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx", ghttp.RespondWith(200, loadData("node.json")))
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx/listeners", ghttp.RespondWith(200, loadData("listeners.json")))
+			s.RouteToHandler("GET", "/api/v3/nodes/emqx/stats/", func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				w.Write(loadData("stats.json"))
+			})
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		It("should give up on endpoints exceeding the timeout", func() {
+			start := time.Now()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			res, err := c.Fetch(ctx)
+
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:   "scrape_success",
+				Value:  float64(0),
+				Labels: map[string]string{"node": "emqx", "endpoint": "nodes_stats"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:   "scrape_success",
+				Value:  float64(1),
+				Labels: map[string]string{"node": "emqx", "endpoint": "nodes_metrics"},
+			}))
+		})
+
+		It("should abort all the requests when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			res, err := c.Fetch(ctx)
+
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("context canceled"))
+			Expect(res).ToNot(ContainElement(MatchFields(IgnoreExtras, Fields{
+				"Name":  Equal("scrape_success"),
+				"Value": Equal(float64(1)),
+			})))
+		})
 
+		It("should not run more requests than allowed", func() {
+			c = NewClient(s.URL(), "emqx", "v3", "admin", "public", WithConcurrency(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			res, err := c.Fetch(ctx)
+
+			//the endpoints are fetched in order, nodes_stats blocks the single
+			//worker until the timeout expires, so the listeners endpoint, always
+			//fetched last, is never requested
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res).To(HaveKeyWithValue("nodes_version", "v3.0.1"))
+			Expect(s.ReceivedRequests()).To(HaveLen(3))
+			Expect(res).To(ContainElement(Sample{
+				Name:   "scrape_success",
+				Value:  float64(1),
+				Labels: map[string]string{"node": "emqx", "endpoint": "nodes_metrics"},
+			}))
+			Expect(res).To(ContainElement(MatchFields(IgnoreExtras, Fields{
+				"Name":   Equal("scrape_success"),
+				"Value":  Equal(float64(0)),
+				"Labels": Equal(map[string]string{"node": "emqx", "endpoint": "listeners"}),
+			})))
+		})
+	})
+
+	Context("Node discovery", func() {
+
+		BeforeEach(func() {
+			c = NewClient(
+				s.URL(),
+				"emqx",
+				"v4",
+				"admin",
+				"public",
+				WithNodeDiscovery(),
+			)
+
+			s.RouteToHandler("GET", "/api/v4/nodes", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("admin", "public"),
+				ghttp.RespondWith(200, loadData("nodes.json")),
+			))
+
+			for _, node := range []string{"emqx@10.0.0.1", "emqx@10.0.0.2"} {
+				s.RouteToHandler("GET", "/api/v4/nodes/"+node+"/metrics/", ghttp.RespondWith(200, loadData("metrics.json")))
+				s.RouteToHandler("GET", "/api/v4/nodes/"+node+"/stats/", ghttp.RespondWith(200, loadData("stats.json")))
+				s.RouteToHandler("GET", "/api/v4/nodes/"+node, ghttp.RespondWith(200, loadData("node.json")))
+				s.RouteToHandler("GET", "/api/v4/nodes/"+node+"/listeners", ghttp.RespondWith(200, loadData("listeners.json")))
+			}
+		})
+
+		It("should fetch the metrics of all the nodes", func() {
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_version",
+				Endpoint: "nodes",
+				Value:    "v3.0.1",
+				Labels:   map[string]string{"node": "emqx@10.0.0.1"},
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_version",
+				Endpoint: "nodes",
+				Value:    "v3.0.1",
+				Labels:   map[string]string{"node": "emqx@10.0.0.2"},
+			}))
+		})
+
+		It("should fail when no nodes are found", func() {
+			s.RouteToHandler("GET", "/api/v4/nodes", ghttp.RespondWith(200, `{"code": 0, "data": []}`))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("No nodes discovered"))
+			Expect(res).To(BeNil())
+		})
+	})
+
+	Context("EMQX 5 api", func() {
+
+		BeforeEach(func() {
+			c = NewClient(
+				s.URL(),
+				"emqx@127.0.0.1",
+				"v5",
+				"key",
+				"secret",
+			)
+
+			s.RouteToHandler("GET", "/api/v5/nodes/emqx@127.0.0.1/metrics", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("key", "secret"),
+				ghttp.RespondWith(200, loadData("v5/metrics.json")),
+			))
+			s.RouteToHandler("GET", "/api/v5/nodes/emqx@127.0.0.1/stats", ghttp.RespondWith(200, loadData("v5/stats.json")))
+			s.RouteToHandler("GET", "/api/v5/nodes/emqx@127.0.0.1", ghttp.RespondWith(200, loadData("v5/node.json")))
+			s.RouteToHandler("GET", "/api/v5/monitor_current/nodes/emqx@127.0.0.1", ghttp.RespondWith(200, loadData("v5/monitor_current.json")))
+		})
+
+		It("should fetch the metrics from the flat responses", func() {
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_metrics_messages.received",
+				Endpoint: "nodes_metrics",
+				Value:    float64(120),
+				Labels:   map[string]string{"node": "emqx@127.0.0.1"},
+				Type:     Counter,
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_stats_connections.count",
+				Endpoint: "nodes_stats",
+				Value:    float64(10),
+				Labels:   map[string]string{"node": "emqx@127.0.0.1"},
+				Type:     Gauge,
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "nodes_version",
+				Endpoint: "nodes",
+				Value:    "5.1.0",
+				Labels:   map[string]string{"node": "emqx@127.0.0.1"},
+				Type:     Gauge,
+			}))
+			Expect(res).To(ContainElement(Sample{
+				Name:     "monitor_current_received_msg_rate",
+				Endpoint: "monitor_current",
+				Value:    float64(12),
+				Labels:   map[string]string{"node": "emqx@127.0.0.1"},
+				Type:     Gauge,
+			}))
+		})
+
+		It("should discover the nodes from the flat node list", func() {
+			s.RouteToHandler("GET", "/api/v5/nodes", ghttp.RespondWith(200, loadData("v5/nodes.json")))
+
+			nodes, err := c.discoverNodes(context.Background())
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(nodes).To(Equal([]string{"emqx@10.0.0.1", "emqx@10.0.0.2"}))
+		})
+
+		It("should fail on error responses", func() {
+			s.RouteToHandler("GET", "/api/v5/nodes/emqx@127.0.0.1/stats", ghttp.RespondWith(404, `{"code": "NOT_FOUND", "message": "node not found"}`))
+
+			data, err := c.get(context.Background(), "/api/v5/nodes/%s/stats")
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Received status code not ok"))
+			Expect(data).To(BeNil())
 		})
 	})
 
@@ -103,7 +402,7 @@ var _ = Describe("Client", func() {
 			statusCode = http.StatusNotFound
 			body = loadData("badresponse.json")
 
-			data, err := c.get(path)
+			data, err := c.get(context.Background(), path)
 
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Received status code not ok"))
@@ -114,7 +413,7 @@ var _ = Describe("Client", func() {
 			statusCode = http.StatusOK
 			body = []byte("not valid json")
 
-			data, err := c.get(path)
+			data, err := c.get(context.Background(), path)
 
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Error in json decoder"))
@@ -125,7 +424,7 @@ var _ = Describe("Client", func() {
 			statusCode = http.StatusOK
 			body = loadData("badresponse.json")
 
-			data, err := c.get(path)
+			data, err := c.get(context.Background(), path)
 
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Recvied code != 0"))
@@ -137,7 +436,7 @@ var _ = Describe("Client", func() {
 			statusCode = http.StatusOK
 			body = loadData("badresponse.json")
 
-			data, err := c.get(path)
+			data, err := c.get(context.Background(), path)
 
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Failed to create http request"))
@@ -151,7 +450,7 @@ var _ = Describe("Client", func() {
 
 			c.setHost("localhost:1859")
 
-			data, err := c.get(path)
+			data, err := c.get(context.Background(), path)
 
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Failed to get metrics"))
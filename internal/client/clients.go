@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"sort"
+)
+
+const (
+	defaultTopClients = 10
+	//MaxTopClients caps the number of top clients exported across all the
+	//fields, bounding the number of clients_top series
+	MaxTopClients = 100
+)
+
+var (
+	//endpoints listing the clients of the cluster
+	clientLists = map[string]string{
+		"v4": "/api/v4/clients",
+		"v5": "/api/v5/clients",
+	}
+	//DefaultClientFields are the client fields ranked by default
+	DefaultClientFields = []string{"mqueue_len", "inflight", "recv_msg"}
+	//DefaultClientBuckets are the default upper bounds of the client fields
+	//histograms
+	DefaultClientBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+	//names of the client fields in v5, when renamed
+	clientFieldAliases = map[string]string{"inflight": "inflight_cnt"}
+	//fields whose histograms would be named like the other clients metrics
+	reservedClientFields = map[string]bool{"top": true, "listed": true, "truncated": true}
+)
+
+//ReservedClientField checks if the field can't be ranked, as its histogram
+//would be named like another clients metric
+func ReservedClientField(field string) bool {
+	return reservedClientFields[field]
+}
+
+//rankedClient is the value of a field of a client
+type rankedClient struct {
+	id    string
+	node  string
+	value float64
+}
+
+//before checks if the client ranks before the other, ties are broken by
+//client id so the ranking is stable between scrapes
+func (r rankedClient) before(other rankedClient) bool {
+	if r.value != other.value {
+		return r.value > other.value
+	}
+	return r.id < other.id
+}
+
+//topClients keeps the n clients with the highest values, in rank order
+type topClients struct {
+	n       int
+	clients []rankedClient
+}
+
+//add adds the client if it ranks among the top n
+func (t *topClients) add(r rankedClient) {
+	i := sort.Search(len(t.clients), func(i int) bool { return r.before(t.clients[i]) })
+	if i >= t.n {
+		return
+	}
+
+	if len(t.clients) < t.n {
+		t.clients = append(t.clients, rankedClient{})
+	}
+	copy(t.clients[i+1:], t.clients[i:])
+	t.clients[i] = r
+}
+
+//newHistogram returns an empty histogram with the given bucket upper bounds
+func newHistogram(bounds []float64) *HistogramValue {
+	h := &HistogramValue{Buckets: make(map[float64]uint64, len(bounds))}
+	for _, b := range bounds {
+		h.Buckets[b] = 0
+	}
+	return h
+}
+
+//observe adds a value to the histogram
+func (h *HistogramValue) observe(v float64) {
+	h.Count++
+	h.Sum += v
+	for b := range h.Buckets {
+		if v <= b {
+			h.Buckets[b]++
+		}
+	}
+}
+
+//clientsJob returns the job of the clients collector. The clients list
+//covers the whole cluster, so it's fetched once from the first node
+func (c *Client) clientsJob(version string, nodes []string) (job, bool) {
+	path, ok := clientLists[version]
+	if !ok || !c.lists.Clients || len(nodes) == 0 {
+		return job{}, false
+	}
+
+	node := nodes[0]
+
+	return job{
+		node:     node,
+		endpoint: "clients",
+		fetch: func(ctx context.Context) ([]Sample, error) {
+			return c.fetchClients(ctx, version, node, path)
+		},
+	}, true
+}
+
+//fetchClients ranks the clients of the cluster by each of the configured
+//fields, keeping the top ones, and counts the values of every node in
+//histograms. Clients whose value is 0 aren't ranked
+func (c *Client) fetchClients(ctx context.Context, version, node, path string) ([]Sample, error) {
+	fields := c.lists.ClientFields
+
+	tops := make([]*topClients, len(fields))
+	for i := range tops {
+		tops[i] = &topClients{n: c.lists.TopClients}
+	}
+
+	//histograms of every node, by field
+	histograms := make(map[string][]*HistogramValue)
+	listed := make(map[string]int)
+
+	truncated, err := c.list(ctx, version, path, func(item map[string]interface{}) {
+		n, ok := item["node"].(string)
+		if !ok {
+			return
+		}
+		id, _ := item["clientid"].(string)
+
+		listed[n]++
+
+		if histograms[n] == nil {
+			histograms[n] = make([]*HistogramValue, len(fields))
+			for i := range fields {
+				histograms[n][i] = newHistogram(c.lists.ClientBuckets)
+			}
+		}
+
+		for i, f := range fields {
+			v, ok := clientField(item, f)
+			if !ok {
+				continue
+			}
+			histograms[n][i].observe(v)
+			if v > 0 && id != "" {
+				tops[i].add(rankedClient{id: id, node: n, value: v})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := []Sample{
+		{Name: "clients_truncated", Endpoint: "clients", Labels: map[string]string{"node": node}, Value: boolValue(truncated)},
+	}
+
+	for n, hs := range histograms {
+		data = append(data, Sample{Name: "clients_listed", Endpoint: "clients", Labels: map[string]string{"node": n}, Value: float64(listed[n])})
+
+		for i, f := range fields {
+			data = append(data, Sample{
+				Name:     "clients_" + f,
+				Endpoint: "clients",
+				Labels:   map[string]string{"node": n},
+				Value:    *hs[i],
+				Type:     Histogram,
+			})
+		}
+	}
+
+	for i, f := range fields {
+		for _, r := range tops[i].clients {
+			data = append(data, Sample{
+				Name:     "clients_top",
+				Endpoint: "clients",
+				Labels:   map[string]string{"node": r.node, "client_id": r.id, "field": f},
+				Value:    r.value,
+			})
+		}
+	}
+
+	return data, nil
+}
+
+//clientField returns the numeric value of a field of a listed client
+func clientField(item map[string]interface{}, field string) (float64, bool) {
+	v, ok := item[field].(float64)
+	if !ok {
+		if alias, found := clientFieldAliases[field]; found {
+			v, ok = item[alias].(float64)
+		}
+	}
+	return v, ok
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Clients collector", func() {
+
+	var s *ghttp.Server
+
+	//helper function to build the samples of the top clients
+	top := func(node, id, field string, value float64) Sample {
+		return Sample{
+			Name:     "clients_top",
+			Endpoint: "clients",
+			Labels:   map[string]string{"node": node, "client_id": id, "field": field},
+			Value:    value,
+		}
+	}
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+		//only the clients are served, the other endpoints fail
+		s.SetAllowUnhandledRequests(true)
+		s.SetUnhandledRequestStatusCode(http.StatusNotFound)
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("should export the top clients of every field", func() {
+		c := NewClient(s.URL(), "emqx@10.0.0.1", "v4", "admin", "public", WithListCollectors(ListConfig{
+			Clients:      true,
+			ClientFields: []string{"mqueue_len", "inflight"},
+			TopClients:   2,
+		}))
+
+		s.RouteToHandler("GET", "/api/v4/clients", ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", "/api/v4/clients", "_page=1&_limit=1000"),
+			ghttp.RespondWith(200, loadData("clients.json")),
+		))
+
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(ContainElement(top("emqx@10.0.0.2", "worker-1", "mqueue_len", 700)))
+		Expect(res).To(ContainElement(top("emqx@10.0.0.1", "sensor-2", "mqueue_len", 40)))
+		Expect(res).ToNot(ContainElement(top("emqx@10.0.0.2", "worker-2", "mqueue_len", 3)))
+		//ties are broken by client id
+		Expect(res).To(ContainElement(top("emqx@10.0.0.2", "worker-1", "inflight", 32)))
+		Expect(res).To(ContainElement(top("emqx@10.0.0.2", "worker-2", "inflight", 32)))
+		Expect(res).ToNot(ContainElement(top("emqx@10.0.0.1", "sensor-2", "inflight", 2)))
+		for _, r := range res {
+			Expect(r.Labels).ToNot(HaveKeyWithValue("field", "recv_msg"))
+		}
+	})
+
+	It("should count the values of every node in histograms", func() {
+		c := NewClient(s.URL(), "emqx@10.0.0.1", "v4", "admin", "public", WithListCollectors(ListConfig{
+			Clients:       true,
+			ClientFields:  []string{"mqueue_len"},
+			ClientBuckets: []float64{0, 10, 100},
+		}))
+
+		s.RouteToHandler("GET", "/api/v4/clients", ghttp.RespondWith(200, loadData("clients.json")))
+
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(ContainElement(Sample{
+			Name:     "clients_mqueue_len",
+			Endpoint: "clients",
+			Labels:   map[string]string{"node": "emqx@10.0.0.2"},
+			Value:    HistogramValue{Count: 2, Sum: 703, Buckets: map[float64]uint64{0: 0, 10: 1, 100: 1}},
+			Type:     Histogram,
+		}))
+		Expect(res).To(ContainElement(Sample{
+			Name:     "clients_listed",
+			Endpoint: "clients",
+			Labels:   map[string]string{"node": "emqx@10.0.0.1"},
+			Value:    float64(2),
+		}))
+	})
+
+	It("should cap the number of top clients", func() {
+		c := NewClient(s.URL(), "emqx", "v4", "admin", "public", WithListCollectors(ListConfig{Clients: true, TopClients: 1000}))
+
+		Expect(c.lists.TopClients * len(c.lists.ClientFields)).To(BeNumerically("<=", MaxTopClients))
+		Expect(c.lists.TopClients).To(Equal(MaxTopClients / len(DefaultClientFields)))
+	})
+
+	It("should not rank the reserved fields", func() {
+		c := NewClient(s.URL(), "emqx", "v4", "admin", "public", WithListCollectors(ListConfig{Clients: true, ClientFields: []string{"top", "mqueue_len", "listed"}}))
+
+		Expect(c.lists.ClientFields).To(Equal([]string{"mqueue_len"}))
+	})
+
+	It("should read the renamed fields of the EMQX 5 api", func() {
+		c := NewClient(s.URL(), "emqx@127.0.0.1", "v5", "key", "secret", WithListCollectors(ListConfig{Clients: true}))
+
+		s.RouteToHandler("GET", "/api/v5/clients", ghttp.RespondWith(200, loadData("v5/clients.json")))
+
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(ContainElement(top("emqx@127.0.0.1", "sensor-1", "inflight", 7)))
+	})
+})
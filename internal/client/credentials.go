@@ -0,0 +1,64 @@
+package client
+
+import "github.com/rs/zerolog/log"
+
+//Credentials are used to authenticate to the emq api
+type Credentials struct {
+	Username string
+	Password string
+}
+
+//CredentialsLoader loads the current credentials, used to pick up
+//rotated credentials without restarting
+type CredentialsLoader func() (Credentials, error)
+
+//WithCredentialsLoader makes the client reload its credentials with load
+//when the api rejects them
+func WithCredentialsLoader(load CredentialsLoader) Option {
+	return func(c *Client) {
+		c.load = load
+	}
+}
+
+//Credentials returns the current credentials of the client
+func (c *Client) Credentials() Credentials {
+	return c.creds.Load().(Credentials)
+}
+
+//SetCredentials atomically replaces the credentials of the client, requests
+//in flight keep the credentials they started with
+func (c *Client) SetCredentials(creds Credentials) {
+	c.creds.Store(creds)
+}
+
+//ReloadCredentials loads the credentials with the client's loader and
+//returns true when they changed
+func (c *Client) ReloadCredentials() (bool, error) {
+	if c.load == nil {
+		return false, nil
+	}
+
+	creds, err := c.load()
+	if err != nil {
+		return false, err
+	}
+
+	if creds == c.Credentials() {
+		return false, nil
+	}
+
+	c.SetCredentials(creds)
+	log.Info().Msg("Reloaded the emq credentials")
+
+	return true, nil
+}
+
+//reloadRejected reloads the credentials after the api rejected the used
+//ones, returning true when the current credentials differ from them
+func (c *Client) reloadRejected(used Credentials) bool {
+	if _, err := c.ReloadCredentials(); err != nil {
+		log.Warn().Msgf("Failed to reload the emq credentials: %v", err)
+	}
+
+	return c.Credentials() != used
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Credentials", func() {
+
+	var (
+		s       *ghttp.Server
+		c       *Client
+		current Credentials
+		loads   int
+		path    = "/api/v4/nodes/%s/stats/"
+	)
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+
+		//only the rotated credentials are accepted
+		s.RouteToHandler("GET", "/api/v4/nodes/emqx/stats/", func(w http.ResponseWriter, r *http.Request) {
+			if _, password, _ := r.BasicAuth(); password != "rotated" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write(loadData("stats.json"))
+		})
+
+		current, loads = Credentials{Username: "admin", Password: "rotated"}, 0
+
+		c = NewClient(s.URL(), "emqx", "v4", "admin", "public", WithCredentialsLoader(func() (Credentials, error) {
+			loads++
+			return current, nil
+		}))
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("should use the credentials it was set", func() {
+		c.SetCredentials(Credentials{Username: "admin", Password: "rotated"})
+
+		_, err := c.get(context.Background(), path)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(loads).To(Equal(0))
+	})
+
+	It("should reload the credentials and retry when they are rejected", func() {
+		_, err := c.get(context.Background(), path)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(loads).To(Equal(1))
+		Expect(c.Credentials()).To(Equal(current))
+		Expect(s.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("should not retry when the credentials didn't change", func() {
+		current = Credentials{Username: "admin", Password: "public"}
+
+		_, err := c.get(context.Background(), path)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("got 401"))
+		Expect(loads).To(Equal(1))
+		Expect(s.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("should keep the credentials when reloading fails", func() {
+		c.load = func() (Credentials, error) { return Credentials{}, errors.New("no credentials") }
+
+		changed, err := c.ReloadCredentials()
+
+		Expect(err).To(HaveOccurred())
+		Expect(changed).To(BeFalse())
+		Expect(c.Credentials()).To(Equal(Credentials{Username: "admin", Password: "public"}))
+	})
+})
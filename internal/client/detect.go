@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	//AutoVersion makes the client detect the api version of the broker
+	AutoVersion = "auto"
+	//consecutive failed fetches after which the api version is detected again
+	redetectAfter = 3
+)
+
+//api versions probed during detection, newest first
+var detectOrder = []string{"v5", "v4", "v3", "v2"}
+
+//version returns the api version the client currently uses
+func (c *Client) version() string {
+	if c.apiVersion != AutoVersion {
+		return c.apiVersion
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.detected
+}
+
+//Detect probes the node list endpoint of every api version, newest first,
+//and selects the first version that answers. The releases of the listed
+//nodes are kept and exported as build info
+func (c *Client) Detect(ctx context.Context) (string, error) {
+	var lastErr error
+
+	for _, version := range detectOrder {
+		var list []map[string]interface{}
+
+		if err := c.request(ctx, version, nodeLists[version], &list); err != nil {
+			log.Debug().Msgf("api version %s isn't available: %v", version, err)
+			lastErr = err
+			continue
+		}
+
+		releases := make(map[string]string, len(list))
+		for _, n := range list {
+			name, ok := nodeName(n)
+			if !ok {
+				continue
+			}
+			if release, ok := n["version"].(string); ok {
+				releases[name] = release
+			}
+		}
+
+		c.mu.Lock()
+		c.detected, c.releases, c.failures = version, releases, 0
+		c.mu.Unlock()
+
+		log.Info().Msgf("Detected api version %s", version)
+
+		return version, nil
+	}
+
+	return "", fmt.Errorf("Failed to detect the api version: %v", lastErr)
+}
+
+//resolveVersion returns the api version to fetch with, detecting it when
+//the client is in auto mode and the version is unknown or keeps failing
+func (c *Client) resolveVersion(ctx context.Context) (string, error) {
+	if c.apiVersion != AutoVersion {
+		return c.apiVersion, nil
+	}
+
+	c.mu.Lock()
+	version, failures := c.detected, c.failures
+	c.mu.Unlock()
+
+	if version != "" && failures < redetectAfter {
+		return version, nil
+	}
+
+	if version != "" {
+		log.Info().Msgf("%d consecutive failed fetches, detecting the api version again", failures)
+	}
+
+	detected, err := c.Detect(ctx)
+	if err != nil {
+		if version == "" {
+			return "", err
+		}
+		log.Warn().Msgf("Keeping api version %s: %v", version, err)
+		return version, nil
+	}
+
+	return detected, nil
+}
+
+//record keeps track of consecutive failed fetches in auto mode
+func (c *Client) record(err error) {
+	if c.apiVersion != AutoVersion {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+}
+
+//buildInfo returns the build info samples of the given nodes, only known
+//for detected api versions
+func (c *Client) buildInfo(version string, nodes []string) []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var data []Sample
+
+	for _, node := range nodes {
+		release, ok := c.releases[node]
+		if !ok {
+			continue
+		}
+		data = append(data, Sample{
+			Name:   "build_info",
+			Labels: map[string]string{"node": node, "api_version": version, "release": release},
+			Value:  float64(1),
+		})
+	}
+
+	return data
+}
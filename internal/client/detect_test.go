@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Detect", func() {
+
+	var (
+		s *ghttp.Server
+		c *Client
+	)
+
+	//routes of a v4 broker with a single node
+	routeV4 := func() {
+		s.RouteToHandler("GET", "/api/v4/nodes", ghttp.RespondWith(200, loadData("nodes.json")))
+		s.RouteToHandler("GET", "/api/v4/nodes/emqx@10.0.0.1/metrics/", ghttp.RespondWith(200, loadData("metrics.json")))
+		s.RouteToHandler("GET", "/api/v4/nodes/emqx@10.0.0.1/stats/", ghttp.RespondWith(200, loadData("stats.json")))
+		s.RouteToHandler("GET", "/api/v4/nodes/emqx@10.0.0.1", ghttp.RespondWith(200, loadData("node.json")))
+		s.RouteToHandler("GET", "/api/v4/nodes/emqx@10.0.0.1/listeners", ghttp.RespondWith(200, loadData("listeners.json")))
+	}
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+		s.SetAllowUnhandledRequests(true)
+		s.SetUnhandledRequestStatusCode(http.StatusNotFound)
+
+		c = NewClient(s.URL(), "emqx@10.0.0.1", AutoVersion, "admin", "public")
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("should detect the api version of the broker", func() {
+		routeV4()
+
+		version, err := c.Detect(context.Background())
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(version).To(Equal("v4"))
+		Expect(c.version()).To(Equal("v4"))
+	})
+
+	It("should export the build info of the detected version", func() {
+		routeV4()
+
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res).To(ContainElement(Sample{
+			Name:   "build_info",
+			Labels: map[string]string{"node": "emqx@10.0.0.1", "api_version": "v4", "release": "4.2.1"},
+			Value:  float64(1),
+		}))
+	})
+
+	It("should fail when no api version answers", func() {
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Failed to detect the api version"))
+		Expect(res).To(BeNil())
+	})
+
+	It("should detect the api version again after repeated failures", func() {
+		routeV4()
+
+		_, err := c.Fetch(context.Background())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		//the broker is upgraded to EMQX 5
+		s.Reset()
+		s.SetAllowUnhandledRequests(true)
+		s.SetUnhandledRequestStatusCode(http.StatusNotFound)
+		s.RouteToHandler("GET", "/api/v5/nodes", ghttp.RespondWith(200, loadData("v5/nodes.json")))
+		s.RouteToHandler("GET", "/api/v5/nodes/emqx@10.0.0.1/metrics", ghttp.RespondWith(200, loadData("v5/metrics.json")))
+		s.RouteToHandler("GET", "/api/v5/nodes/emqx@10.0.0.1/stats", ghttp.RespondWith(200, loadData("v5/stats.json")))
+		s.RouteToHandler("GET", "/api/v5/nodes/emqx@10.0.0.1", ghttp.RespondWith(200, loadData("v5/node.json")))
+		s.RouteToHandler("GET", "/api/v5/monitor_current/nodes/emqx@10.0.0.1", ghttp.RespondWith(200, loadData("v5/monitor_current.json")))
+
+		for i := 0; i < redetectAfter; i++ {
+			_, err := c.Fetch(context.Background())
+			Expect(err).Should(HaveOccurred())
+			Expect(c.version()).To(Equal("v4"))
+		}
+
+		res, err := c.Fetch(context.Background())
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.version()).To(Equal("v5"))
+		Expect(res).To(ContainElement(Sample{
+			Name:   "build_info",
+			Labels: map[string]string{"node": "emqx@10.0.0.1", "api_version": "v5", "release": "5.1.0"},
+			Value:  float64(1),
+		}))
+	})
+})
@@ -0,0 +1,390 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultPageSize    = 1000
+	defaultMaxPages    = 10
+	defaultMaxPrefixes = 20
+	//prefix of the topics beyond the top prefixes
+	otherPrefix = "_other"
+	//prefix of the topics starting with a slash, whose first level is empty
+	rootPrefix = "/"
+)
+
+var (
+	//endpoints listing the subscriptions of a node
+	subscriptionLists = map[string]string{
+		"v3": "/api/v3/nodes/%s/subscriptions",
+		"v4": "/api/v4/nodes/%s/subscriptions",
+		"v5": "/api/v5/subscriptions?node=%s",
+	}
+	//endpoints listing the topics of the cluster along with the nodes
+	//subscribing to them, the routes before v5
+	topicLists = map[string]string{
+		"v3": "/api/v3/routes",
+		"v4": "/api/v4/routes",
+		"v5": "/api/v5/topics",
+	}
+	//prefixes of shared subscriptions topics
+	sharedPrefixes = []string{"$share/", "$queue/"}
+	qosLevels      = []string{"0", "1", "2"}
+)
+
+//ListConfig configures the collectors paging through the subscriptions,
+//topics and clients lists of the emq api. Only aggregates and top values
+//are exported, so the number of metrics stays bounded
+type ListConfig struct {
+	Subscriptions bool
+	Topics        bool
+	//number of items per page
+	PageSize int
+	//maximum number of pages fetched per list and scrape, the aggregates
+	//of longer lists are partial
+	MaxPages int
+	//maximum number of top level prefixes the topics are counted by, the
+	//others are counted together
+	MaxTopicPrefixes int
+	Clients          bool
+	//numeric fields the clients are ranked by
+	ClientFields []string
+	//number of clients exported per field, at most MaxTopClients across all
+	//the fields
+	TopClients int
+	//upper bounds of the buckets of the client fields histograms
+	ClientBuckets []float64
+}
+
+//WithListCollectors enables the collectors of the subscriptions, topics and
+//clients lists
+func WithListCollectors(cfg ListConfig) Option {
+	return func(c *Client) {
+		if cfg.PageSize <= 0 {
+			cfg.PageSize = defaultPageSize
+		}
+		if cfg.MaxPages <= 0 {
+			cfg.MaxPages = defaultMaxPages
+		}
+		if cfg.MaxTopicPrefixes <= 0 {
+			cfg.MaxTopicPrefixes = defaultMaxPrefixes
+		}
+		fields := make([]string, 0, len(cfg.ClientFields))
+		for _, f := range cfg.ClientFields {
+			if !ReservedClientField(f) {
+				fields = append(fields, f)
+			}
+		}
+		cfg.ClientFields = fields
+		if len(cfg.ClientFields) == 0 {
+			cfg.ClientFields = DefaultClientFields
+		}
+		if cfg.TopClients <= 0 {
+			cfg.TopClients = defaultTopClients
+		}
+		if cfg.TopClients*len(cfg.ClientFields) > MaxTopClients {
+			cfg.TopClients = MaxTopClients / len(cfg.ClientFields)
+		}
+		if len(cfg.ClientBuckets) == 0 {
+			cfg.ClientBuckets = DefaultClientBuckets
+		}
+		c.lists = cfg
+	}
+}
+
+//pageMeta is the pagination metadata of a list response
+type pageMeta struct {
+	Count   int   `json:"count"`
+	HasNext *bool `json:"hasnext"`
+}
+
+//listJobs returns the jobs of the enabled list collectors. The topics list
+//is the same on every node, so it's fetched once from the first node, as
+//the clients list
+func (c *Client) listJobs(version string, nodes []string) []job {
+	var jobs []job
+
+	if path, ok := subscriptionLists[version]; ok && c.lists.Subscriptions {
+		for _, node := range nodes {
+			node := node
+			jobs = append(jobs, job{
+				node:     node,
+				endpoint: "subscriptions",
+				fetch: func(ctx context.Context) ([]Sample, error) {
+					return c.fetchSubscriptions(ctx, version, node, fmt.Sprintf(path, escapeNode(version, node)))
+				},
+			})
+		}
+	}
+
+	if path, ok := topicLists[version]; ok && c.lists.Topics && len(nodes) > 0 {
+		node := nodes[0]
+		jobs = append(jobs, job{
+			node:     node,
+			endpoint: "topics",
+			fetch: func(ctx context.Context) ([]Sample, error) {
+				return c.fetchTopics(ctx, version, node, path)
+			},
+		})
+	}
+
+	if j, ok := c.clientsJob(version, nodes); ok {
+		jobs = append(jobs, j)
+	}
+
+	return jobs
+}
+
+//fetchSubscriptions counts the subscriptions of the given node by QoS, and
+//the shared subscriptions
+func (c *Client) fetchSubscriptions(ctx context.Context, version, node, path string) ([]Sample, error) {
+	byQoS := make(map[string]int, len(qosLevels))
+	shared, listed := 0, 0
+
+	truncated, err := c.list(ctx, version, path, func(item map[string]interface{}) {
+		listed++
+
+		byQoS[fmt.Sprint(item["qos"])]++
+
+		topic, _ := item["topic"].(string)
+		group, _ := item["share_group"].(string)
+		if group != "" || hasAnyPrefix(topic, sharedPrefixes) {
+			shared++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{"node": node}
+
+	data := []Sample{
+		{Name: "subscriptions_listed", Endpoint: "subscriptions", Labels: labels, Value: float64(listed)},
+		{Name: "subscriptions_shared", Endpoint: "subscriptions", Labels: labels, Value: float64(shared)},
+		{Name: "subscriptions_truncated", Endpoint: "subscriptions", Labels: labels, Value: boolValue(truncated)},
+	}
+
+	//unknown levels are left out to keep the number of series bounded
+	for _, qos := range qosLevels {
+		data = append(data, Sample{
+			Name:     "subscriptions_by_qos",
+			Endpoint: "subscriptions",
+			Labels:   map[string]string{"node": node, "qos": qos},
+			Value:    float64(byQoS[qos]),
+		})
+	}
+
+	return data, nil
+}
+
+//fetchTopics counts the topics subscribed on every node by top level
+//prefix. Only the most common prefixes of the cluster are kept, the other
+//topics are counted under the _other prefix
+func (c *Client) fetchTopics(ctx context.Context, version, node, path string) ([]Sample, error) {
+	//topic counts by node and prefix
+	counts := make(map[string]map[string]int)
+	totals := make(map[string]int)
+
+	truncated, err := c.list(ctx, version, path, func(item map[string]interface{}) {
+		topic, _ := item["topic"].(string)
+		n, ok := item["node"].(string)
+		if !ok {
+			return
+		}
+
+		prefix := topicPrefix(topic)
+
+		if counts[n] == nil {
+			counts[n] = make(map[string]int)
+		}
+		counts[n][prefix]++
+		totals[prefix]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	top := topKeys(totals, c.lists.MaxTopicPrefixes)
+
+	data := []Sample{
+		{Name: "topics_truncated", Endpoint: "topics", Labels: map[string]string{"node": node}, Value: boolValue(truncated)},
+	}
+
+	for n, prefixes := range counts {
+		byPrefix := make(map[string]int, len(top)+1)
+		listed := 0
+
+		for prefix, count := range prefixes {
+			listed += count
+			if !top[prefix] {
+				prefix = otherPrefix
+			}
+			byPrefix[prefix] += count
+		}
+
+		data = append(data, Sample{Name: "topics_listed", Endpoint: "topics", Labels: map[string]string{"node": n}, Value: float64(listed)})
+
+		for prefix, count := range byPrefix {
+			data = append(data, Sample{
+				Name:     "topics_by_prefix",
+				Endpoint: "topics",
+				Labels:   map[string]string{"node": n, "prefix": prefix},
+				Value:    float64(count),
+			})
+		}
+	}
+
+	return data, nil
+}
+
+//topicPrefix returns the top level of a topic
+func topicPrefix(topic string) string {
+	if strings.HasPrefix(topic, "/") {
+		return rootPrefix
+	}
+	return strings.SplitN(topic, "/", 2)[0]
+}
+
+//escapeNode escapes the node name for the subscriptions path of version,
+//v5 takes it as a query parameter
+func escapeNode(version, node string) string {
+	if version == "v5" {
+		return url.QueryEscape(node)
+	}
+	return node
+}
+
+//list pages through the list at path, calling each for every item. It
+//stops after the maximum number of pages, reporting the list as truncated
+func (c *Client) list(ctx context.Context, version, path string, each func(map[string]interface{})) (bool, error) {
+	//v5 dropped the underscore prefix of the pagination parameters
+	pageParam, limitParam := "_page", "_limit"
+	if version == "v5" {
+		pageParam, limitParam = "page", "limit"
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	for page := 1; page <= c.lists.MaxPages; page++ {
+		u := fmt.Sprintf("%s%s%s=%d&%s=%d", path, sep, pageParam, page, limitParam, c.lists.PageSize)
+
+		items, meta, err := c.page(ctx, version, u)
+		if err != nil {
+			return false, err
+		}
+
+		for _, item := range items {
+			each(item)
+		}
+
+		if !meta.more(page, c.lists.PageSize, len(items)) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+//page fetches a single page of a list
+func (c *Client) page(ctx context.Context, version, path string) ([]map[string]interface{}, pageMeta, error) {
+	var (
+		items []map[string]interface{}
+		meta  pageMeta
+	)
+
+	er, err := c.response(ctx, version, path)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	//v5 isn't wrapped in an envelope, the items and metadata are in the body
+	if version == "v5" {
+		body := er.Data
+		er = &emqResponse{}
+		if err := json.Unmarshal(body, er); err != nil {
+			return nil, meta, fmt.Errorf("Error in json decoder %v", err)
+		}
+	}
+
+	if len(er.Data) > 0 {
+		if err := json.Unmarshal(er.Data, &items); err != nil {
+			return nil, meta, fmt.Errorf("Error in json decoder %v", err)
+		}
+	}
+
+	if len(er.Meta) > 0 {
+		if err := json.Unmarshal(er.Meta, &meta); err != nil {
+			return nil, meta, fmt.Errorf("Error in json decoder %v", err)
+		}
+	}
+
+	return items, meta, nil
+}
+
+//more checks if there are pages after the given one. v3 doesn't tell, so
+//the count is used, and a full page is assumed to have a next one when
+//there's no metadata at all
+func (m pageMeta) more(page, limit, items int) bool {
+	switch {
+	case m.HasNext != nil:
+		return *m.HasNext
+	case m.Count > 0:
+		return page*limit < m.Count
+	default:
+		return items == limit
+	}
+}
+
+//topKeys returns the n keys with the highest counts, ties are broken by key
+//so the selection is stable between scrapes
+func topKeys(counts map[string]int, n int) map[string]bool {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	top := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		top[k] = true
+	}
+
+	return top
+}
+
+//hasAnyPrefix checks if s starts with any of the prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//boolValue returns 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("List collectors", func() {
+
+	var s *ghttp.Server
+
+	//helper function to build the samples of the list endpoints
+	sample := func(name, endpoint string, value float64, labels map[string]string) Sample {
+		return Sample{Name: name, Endpoint: endpoint, Value: value, Labels: labels}
+	}
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+		//only the lists are served, the other endpoints fail
+		s.SetAllowUnhandledRequests(true)
+		s.SetUnhandledRequestStatusCode(http.StatusNotFound)
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	Context("subscriptions", func() {
+
+		var c *Client
+
+		BeforeEach(func() {
+			c = NewClient(s.URL(), "emqx", "v4", "admin", "public", WithListCollectors(ListConfig{Subscriptions: true, PageSize: 3}))
+
+			s.RouteToHandler("GET", "/api/v4/nodes/emqx/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Query().Get("_limit")).To(Equal("3"))
+				switch r.URL.Query().Get("_page") {
+				case "1":
+					w.Write(loadData("subscriptions_page1.json"))
+				case "2":
+					w.Write(loadData("subscriptions_page2.json"))
+				default:
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			})
+		})
+
+		It("should count the subscriptions of all the pages", func() {
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(ContainElement(sample("subscriptions_listed", "subscriptions", 5, map[string]string{"node": "emqx"})))
+			Expect(res).To(ContainElement(sample("subscriptions_shared", "subscriptions", 2, map[string]string{"node": "emqx"})))
+			Expect(res).To(ContainElement(sample("subscriptions_truncated", "subscriptions", 0, map[string]string{"node": "emqx"})))
+			Expect(res).To(ContainElement(sample("subscriptions_by_qos", "subscriptions", 2, map[string]string{"node": "emqx", "qos": "0"})))
+			Expect(res).To(ContainElement(sample("subscriptions_by_qos", "subscriptions", 2, map[string]string{"node": "emqx", "qos": "1"})))
+			Expect(res).To(ContainElement(sample("subscriptions_by_qos", "subscriptions", 1, map[string]string{"node": "emqx", "qos": "2"})))
+		})
+
+		It("should stop after the maximum number of pages", func() {
+			c = NewClient(s.URL(), "emqx", "v4", "admin", "public", WithListCollectors(ListConfig{Subscriptions: true, PageSize: 3, MaxPages: 1}))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(ContainElement(sample("subscriptions_listed", "subscriptions", 3, map[string]string{"node": "emqx"})))
+			Expect(res).To(ContainElement(sample("subscriptions_truncated", "subscriptions", 1, map[string]string{"node": "emqx"})))
+		})
+	})
+
+	Context("topics", func() {
+
+		It("should count the topics of every node by the top prefixes", func() {
+			c := NewClient(s.URL(), "emqx@10.0.0.1", "v4", "admin", "public", WithListCollectors(ListConfig{Topics: true, MaxTopicPrefixes: 2}))
+
+			s.RouteToHandler("GET", "/api/v4/routes", ghttp.RespondWith(200, loadData("routes.json")))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+
+			node1 := func(prefix string) map[string]string {
+				return map[string]string{"node": "emqx@10.0.0.1", "prefix": prefix}
+			}
+			node2 := func(prefix string) map[string]string {
+				return map[string]string{"node": "emqx@10.0.0.2", "prefix": prefix}
+			}
+
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 2, node1("sensors"))))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, node1("$SYS"))))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, node1(otherPrefix))))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, node2("sensors"))))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, node2(otherPrefix))))
+			Expect(res).ToNot(ContainElement(sample("topics_by_prefix", "topics", 1, node1("alerts"))))
+			Expect(res).To(ContainElement(sample("topics_listed", "topics", 4, map[string]string{"node": "emqx@10.0.0.1"})))
+			Expect(res).To(ContainElement(sample("topics_listed", "topics", 2, map[string]string{"node": "emqx@10.0.0.2"})))
+			Expect(res).To(ContainElement(sample("topics_truncated", "topics", 0, map[string]string{"node": "emqx@10.0.0.1"})))
+		})
+
+		It("should count the topics starting with a slash under the / prefix", func() {
+			c := NewClient(s.URL(), "emqx", "v4", "admin", "public", WithListCollectors(ListConfig{Topics: true}))
+
+			s.RouteToHandler("GET", "/api/v4/routes", ghttp.RespondWith(200, `{"code": 0, "data": [
+				{"topic": "/devices/1", "node": "emqx"},
+				{"topic": "/devices/2", "node": "emqx"},
+				{"topic": "devices/3", "node": "emqx"}
+			]}`))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 2, map[string]string{"node": "emqx", "prefix": "/"})))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, map[string]string{"node": "emqx", "prefix": "devices"})))
+		})
+	})
+
+	Context("EMQX 5 api", func() {
+
+		It("should page through the flat responses", func() {
+			c := NewClient(s.URL(), "emqx@127.0.0.1", "v5", "key", "secret", WithListCollectors(ListConfig{Subscriptions: true, Topics: true}))
+
+			s.RouteToHandler("GET", "/api/v5/subscriptions", ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/v5/subscriptions", "node=emqx%40127.0.0.1&page=1&limit=1000"),
+				ghttp.RespondWith(200, loadData("v5/subscriptions.json")),
+			))
+			s.RouteToHandler("GET", "/api/v5/topics", ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/api/v5/topics", "page=1&limit=1000"),
+				ghttp.RespondWith(200, loadData("v5/topics.json")),
+			))
+
+			res, err := c.Fetch(context.Background())
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(ContainElement(sample("subscriptions_shared", "subscriptions", 1, map[string]string{"node": "emqx@127.0.0.1"})))
+			Expect(res).To(ContainElement(sample("subscriptions_by_qos", "subscriptions", 1, map[string]string{"node": "emqx@127.0.0.1", "qos": "2"})))
+			Expect(res).To(ContainElement(sample("topics_by_prefix", "topics", 1, map[string]string{"node": "emqx@127.0.0.1", "prefix": "jobs"})))
+		})
+	})
+})
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//helper function to write pem encoded data to a file in dir
+func writePEM(dir, name, kind string, der []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+	Expect(err).ToNot(HaveOccurred())
+	return path
+}
+
+//helper function to create a self signed client certificate and key
+func clientCert(dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "emq_exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return writePEM(dir, "client.crt", "CERTIFICATE", der), writePEM(dir, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+var _ = Describe("TLS", func() {
+
+	var (
+		s      *httptest.Server
+		dir    string
+		caFile string
+	)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(loadData("stats.json"))
+	})
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "emq_exporter")
+		Expect(err).ToNot(HaveOccurred())
+
+		s = httptest.NewUnstartedServer(handler)
+		s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		s.StartTLS()
+
+		caFile = writePEM(dir, "ca.crt", "CERTIFICATE", s.Certificate().Raw)
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	get := func(cfg TLSConfig) error {
+		tc, err := NewTLSConfig(cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		c := NewClient(s.URL, "emqx", "v3", "admin", "public", WithTransport(NewTLSTransport(tc)))
+		_, err = c.get(context.Background(), "/api/v3/nodes/%s/stats")
+		return err
+	}
+
+	It("should share the transport between the clients created with the same options", func() {
+		tc, err := NewTLSConfig(TLSConfig{CAFile: caFile})
+		Expect(err).ToNot(HaveOccurred())
+
+		opts := []Option{WithTransport(NewTLSTransport(tc))}
+		c1 := NewClient(s.URL, "emqx", "v3", "admin", "public", opts...)
+		c2 := NewClient(s.URL, "emqx", "v3", "admin", "public", opts...)
+
+		Expect(c1.hc.Transport).To(BeIdenticalTo(c2.hc.Transport))
+	})
+
+	It("should fail to verify an unknown server", func() {
+		err := get(TLSConfig{})
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+	})
+
+	It("should trust a server signed by the CA", func() {
+		Expect(get(TLSConfig{CAFile: caFile})).To(Succeed())
+	})
+
+	It("should verify the server name", func() {
+		err := get(TLSConfig{CAFile: caFile, ServerName: "emq.invalid"})
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("emq.invalid"))
+
+		//the httptest certificate is valid for example.com
+		Expect(get(TLSConfig{CAFile: caFile, ServerName: "example.com"})).To(Succeed())
+	})
+
+	It("should skip verification when asked to", func() {
+		Expect(get(TLSConfig{InsecureSkipVerify: true})).To(Succeed())
+	})
+
+	It("should present the client certificate", func() {
+		certFile, keyFile := clientCert(dir)
+
+		s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.PeerCertificates) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			handler(w, r)
+		})
+
+		err := get(TLSConfig{CAFile: caFile})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("401"))
+
+		Expect(get(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})).To(Succeed())
+	})
+
+	Context("invalid configuration", func() {
+
+		It("should fail on a missing CA file", func() {
+			_, err := NewTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "nothere.crt")})
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Failed to read CA file"))
+		})
+
+		It("should fail on a CA file without certificates", func() {
+			path := filepath.Join(dir, "empty.crt")
+			Expect(ioutil.WriteFile(path, []byte("not a certificate"), 0600)).To(Succeed())
+
+			_, err := NewTLSConfig(TLSConfig{CAFile: path})
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("No certificates found"))
+		})
+
+		It("should fail on a certificate without a key", func() {
+			certFile, _ := clientCert(dir)
+
+			_, err := NewTLSConfig(TLSConfig{CertFile: certFile})
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Both a client certificate and a key must be set"))
+		})
+	})
+})
@@ -0,0 +1,75 @@
+package client
+
+import "strings"
+
+//ValueType is the kind of value fetched from the emq api
+type ValueType int
+
+const (
+	//Gauge is a value that can arbitrarily go up and down
+	Gauge ValueType = iota
+	//Counter is a cumulative value that only goes up
+	Counter
+	//Histogram is a distribution of values, given as a HistogramValue
+	Histogram
+)
+
+//HistogramValue is the value of a Histogram sample
+type HistogramValue struct {
+	Count uint64
+	Sum   float64
+	//cumulative counts by upper bound
+	Buckets map[float64]uint64
+}
+
+var (
+	//value types of the scraped endpoints, per api version
+	endpointTypes = map[string]map[string]ValueType{
+		"v2": {
+			"monitoring_metrics": Counter,
+			"monitoring_stats":   Gauge,
+			"monitoring_nodes":   Gauge,
+			"management_nodes":   Gauge,
+		},
+		"v3": {
+			"nodes_metrics": Counter,
+			"nodes_stats":   Gauge,
+			"nodes":         Gauge,
+		},
+		"v4": {
+			"nodes_metrics": Counter,
+			"nodes_stats":   Gauge,
+			"nodes":         Gauge,
+		},
+		"v5": {
+			"nodes_metrics":   Counter,
+			"nodes_stats":     Gauge,
+			"nodes":           Gauge,
+			"monitor_current": Gauge,
+		},
+	}
+
+	//key suffixes of current values, these are gauges regardless of
+	//the endpoint they were fetched from
+	gaugeSuffixes = []string{"/count", "/max", "_count", "_max"}
+)
+
+//classify returns the value type of a key fetched from the given endpoint
+func classify(apiVersion, endpoint, key string) ValueType {
+	for _, s := range gaugeSuffixes {
+		if strings.HasSuffix(key, s) {
+			return Gauge
+		}
+	}
+
+	if t, ok := endpointTypes[apiVersion][endpoint]; ok {
+		return t
+	}
+
+	//fall back to the endpoint naming convention
+	if strings.HasSuffix(endpoint, "metrics") {
+		return Counter
+	}
+
+	return Gauge
+}
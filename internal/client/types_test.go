@@ -0,0 +1,27 @@
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Value types", func() {
+
+	DescribeTable("classifying fetched keys",
+		func(apiVersion, endpoint, key string, expected ValueType) {
+			Expect(classify(apiVersion, endpoint, key)).To(Equal(expected))
+		},
+		Entry("v4 metrics are counters", "v4", "nodes_metrics", "messages/received", Counter),
+		Entry("v3 metrics are counters", "v3", "nodes_metrics", "packets/publish/received", Counter),
+		Entry("v2 metrics are counters", "v2", "monitoring_metrics", "bytes/sent", Counter),
+		Entry("v5 metrics are counters", "v5", "nodes_metrics", "messages.received", Counter),
+		Entry("v5 current rates are gauges", "v5", "monitor_current", "received_msg_rate", Gauge),
+		Entry("stats are gauges", "v4", "nodes_stats", "connections/count", Gauge),
+		Entry("node info are gauges", "v3", "nodes", "memory_used", Gauge),
+		Entry("counts are gauges on any endpoint", "v4", "nodes_metrics", "retained/count", Gauge),
+		Entry("high watermarks are gauges on any endpoint", "v2", "monitoring_metrics", "sessions/max", Gauge),
+		Entry("unknown metrics endpoints are counters", "v9", "cluster_metrics", "messages/sent", Counter),
+		Entry("unknown endpoints are gauges", "v9", "cluster_stats", "topics", Gauge),
+	)
+})
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// WithPollInterval makes the exporter serve the results of the last poll
+// of EMQ instead of scraping it on every collection. Polling is started
+// with Poll
+func WithPollInterval(d time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.pollInterval = d
+	}
+}
+
+// Poll scrapes EMQ right away and then every poll interval, until the
+// context is done. Every poll is limited to the poll interval
+func (e *Exporter) Poll(ctx context.Context) {
+	ticker := time.NewTicker(e.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		e.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//poll scrapes EMQ once and keeps the results for the next collections
+func (e *Exporter) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.pollInterval)
+	defer cancel()
+
+	err := e.scrape(ctx)
+	e.record(err)
+
+	e.mu.Lock()
+	e.lastPoll = e.now()
+	e.mu.Unlock()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	"github.com/rs/zerolog/log"
+)
+
+//probeHandler returns a handler that scrapes the EMQ node given by the
+//target and node query parameters, blackbox exporter style.
+//A new client, exporter and registry are created for every request, so a single
+//emq_exporter can serve all the nodes in a cluster. The clients use the
+//credentials creds returns for the target, targets without any are probed
+//without credentials, so they aren't sent to arbitrary hosts
+func probeHandler(defaultNode, apiVersion string, creds func(target string) (client.Credentials, bool), offset time.Duration, clientOpts []client.Option, opts ...ExporterOption) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		target := params.Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		node := params.Get("node")
+		if node == "" {
+			node = defaultNode
+		}
+
+		log.Debug().Msgf("Probing %s on %s", node, target)
+
+		cr, ok := creds(target)
+		if !ok {
+			log.Debug().Msgf("%s isn't an allowed probe target, probing without credentials", target)
+		}
+		c := client.NewClient(target, node, apiVersion, cr.Username, cr.Password, clientOpts...)
+
+		serveScrape(w, r, []*Exporter{NewExporter(c, append([]ExporterOption{WithNodeLabel(node)}, opts...)...)}, offset)
+	}
+}
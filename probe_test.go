@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/nuvo/emq_exporter/internal/client"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Probe", func() {
+
+	var (
+		s       *ghttp.Server
+		handler http.HandlerFunc
+	)
+
+	BeforeEach(func() {
+		s = ghttp.NewServer()
+		s.AllowUnhandledRequests = true
+		s.UnhandledRequestStatusCode = http.StatusNotFound
+
+		s.RouteToHandler("GET", "/api/v3/nodes/emqx@10.0.0.1/stats/", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("admin", "public"),
+			ghttp.RespondWith(200, `{"code": 0, "data": {"connections/count": 42}}`),
+		))
+		s.RouteToHandler("GET", "/api/v3/nodes/emqx@10.0.0.1/metrics/", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("admin", "public"),
+			ghttp.RespondWith(200, `{"code": 0, "data": {"messages/received": 7}}`),
+		))
+		s.RouteToHandler("GET", "/api/v3/nodes/emqx@10.0.0.1", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("admin", "public"),
+			ghttp.RespondWith(200, `{"code": 0, "data": {"connections": 3}}`),
+		))
+		s.RouteToHandler("GET", "/api/v3/nodes/emqx@10.0.0.1/listeners", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("admin", "public"),
+			ghttp.RespondWith(200, `{"code": 0, "data": []}`),
+		))
+
+		handler = probeHandler("emqx@127.0.0.1", "v3", func(target string) (client.Credentials, bool) {
+			if target != s.URL() {
+				return client.Credentials{}, false
+			}
+			return client.Credentials{Username: "admin", Password: "public"}, true
+		}, 0, nil)
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	probe := func(params url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/probe?"+params.Encode(), nil)
+		handler(rec, req)
+		return rec
+	}
+
+	It("should fail when the target is missing", func() {
+		rec := probe(url.Values{"node": {"emqx@10.0.0.1"}})
+
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should scrape the requested node", func() {
+		rec := probe(url.Values{"target": {s.URL()}, "node": {"emqx@10.0.0.1"}})
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		body, err := ioutil.ReadAll(rec.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`emq_nodes_stats_connections_count{node="emqx@10.0.0.1"} 42`))
+	})
+
+	It("should fall back to the default node", func() {
+		rec := probe(url.Values{"target": {s.URL()}})
+
+		body, err := ioutil.ReadAll(rec.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`emq_up{node="emqx@127.0.0.1"} 0`))
+		Expect(string(body)).ToNot(ContainSubstring("emq_nodes_stats_connections_count"))
+	})
+
+	It("should not send credentials to other targets", func() {
+		other := ghttp.NewServer()
+		defer other.Close()
+		other.AllowUnhandledRequests = true
+		other.UnhandledRequestStatusCode = http.StatusUnauthorized
+
+		rec := probe(url.Values{"target": {other.URL()}, "node": {"emqx@10.0.0.1"}})
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(other.ReceivedRequests()).ToNot(BeEmpty())
+		for _, r := range other.ReceivedRequests() {
+			Expect(r.Header.Get("Authorization")).To(BeEmpty())
+		}
+	})
+})
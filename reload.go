@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//watchFile calls reload whenever the file at path changes, checking every
+//interval until the context is done. Replacing the file, as done when a
+//Kubernetes secret is updated, counts as a change
+func watchFile(ctx context.Context, path string, interval time.Duration, reload func()) {
+	last, _ := os.Stat(path)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Debug().Msgf("can't stat %s: %v", path, err)
+			continue
+		}
+
+		if last != nil && os.SameFile(fi, last) && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+
+		log.Debug().Msgf("%s changed", path)
+		last = fi
+		reload()
+	}
+}
+
+//onSignal calls reload whenever the process receives SIGHUP, until the
+//context is done
+func onSignal(ctx context.Context, reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			log.Info().Msg("Received SIGHUP")
+			reload()
+		}
+	}
+}
+
+//reloadHandler returns a handler calling reload on POST and PUT requests,
+//Prometheus style
+func reloadHandler(reload func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload the configuration")
+			http.Error(w, fmt.Sprintf("failed to reload the configuration: %v", err), http.StatusInternalServerError)
+		}
+	}
+}
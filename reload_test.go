@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("watchFile", func() {
+
+	var (
+		dir     string
+		path    string
+		reloads int32
+		cancel  context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "emq_exporter")
+		Expect(err).ToNot(HaveOccurred())
+
+		path = filepath.Join(dir, "auth.json")
+		Expect(ioutil.WriteFile(path, []byte(`{"username": "admin", "password": "public"}`), 0600)).To(Succeed())
+
+		atomic.StoreInt32(&reloads, 0)
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go watchFile(ctx, path, 10*time.Millisecond, func() { atomic.AddInt32(&reloads, 1) })
+	})
+
+	AfterEach(func() {
+		cancel()
+		os.RemoveAll(dir)
+	})
+
+	It("should not reload an unchanged file", func() {
+		Consistently(func() int32 { return atomic.LoadInt32(&reloads) }, 100*time.Millisecond).Should(BeZero())
+	})
+
+	It("should reload when the file is replaced", func() {
+		//let the watcher see the original file first
+		time.Sleep(50 * time.Millisecond)
+
+		//swap the file the way kubernetes updates mounted secrets
+		tmp := filepath.Join(dir, "auth.json.tmp")
+		Expect(ioutil.WriteFile(tmp, []byte(`{"username": "admin", "password": "rotated"}`), 0600)).To(Succeed())
+		Expect(os.Rename(tmp, path)).To(Succeed())
+
+		Eventually(func() int32 { return atomic.LoadInt32(&reloads) }).Should(BeNumerically("==", 1))
+		Consistently(func() int32 { return atomic.LoadInt32(&reloads) }, 100*time.Millisecond).Should(BeNumerically("==", 1))
+	})
+})
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	//labels set by the exporter, which the rules can't override
+	reservedLabels = map[string]bool{
+		"node": true, brokerLabel: true, "endpoint": true, "protocol": true, "listen_on": true, "qos": true,
+		"client_id": true, "field": true, "prefix": true, "api_version": true, "release": true,
+	}
+)
+
+//renameRule renames the metrics whose name matches, and can move parts of
+//the name to labels. The name, help and label values may refer to the
+//groups of the match, e.g. $1 or ${type}. Counters are matched without
+//their _total suffix, which is added back to the new name
+type renameRule struct {
+	Match  string            `yaml:"match"`
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+//renamer applies the first matching rename rule to the metrics
+type renamer []compiledRule
+
+type compiledRule struct {
+	renameRule
+	re *regexp.Regexp
+}
+
+// WithRenamer renames the exported metrics with the given renamer
+func WithRenamer(r renamer) ExporterOption {
+	return func(e *Exporter) {
+		e.renamer = r
+	}
+}
+
+//loadRenameRules reads the YAML list of rename rules at path
+func loadRenameRules(path string) ([]renameRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []renameRule
+	if err := yaml.UnmarshalStrict(b, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rename rules file %s: %v", path, err)
+	}
+
+	if _, err := newRenamer(rules); err != nil {
+		return nil, fmt.Errorf("invalid rename rules file %s: %v", path, err)
+	}
+
+	return rules, nil
+}
+
+//newRenamer validates and compiles the rules, matching whole metric names
+func newRenamer(rules []renameRule) (renamer, error) {
+	r := make(renamer, 0, len(rules))
+
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("rename_rules[%d]: match is required", i)
+		}
+
+		re, err := regexp.Compile("^(?:" + rule.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rename_rules[%d]: invalid match pattern %q: %v", i, rule.Match, err)
+		}
+
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rename_rules[%d]: name is required", i)
+		}
+
+		//names with references are checked once expanded
+		if !strings.Contains(rule.Name, "$") && !metricName.MatchString(rule.Name) {
+			return nil, fmt.Errorf("rename_rules[%d]: invalid metric name %q", i, rule.Name)
+		}
+
+		for k := range rule.Labels {
+			if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+				return nil, fmt.Errorf("rename_rules[%d]: invalid label name %q", i, k)
+			}
+			if reservedLabels[k] {
+				return nil, fmt.Errorf("rename_rules[%d]: label %q is reserved", i, k)
+			}
+		}
+
+		r = append(r, compiledRule{rule, re})
+	}
+
+	return r, nil
+}
+
+//rename returns the name, help and labels of a metric after applying the
+//first matching rule. They are returned unchanged when no rule matches, or
+//when the rule expands to an invalid name
+func (r renamer) rename(fqName, help string, labels map[string]string) (string, string, map[string]string) {
+	for _, rule := range r {
+		match := rule.re.FindStringSubmatchIndex(fqName)
+		if match == nil {
+			continue
+		}
+
+		expand := func(template string) string {
+			return string(rule.re.ExpandString(nil, template, fqName, match))
+		}
+
+		name := expand(rule.Name)
+		if !metricName.MatchString(name) {
+			log.Debug().Msgf("not renaming %s, %q is an invalid metric name", fqName, name)
+			return fqName, help, labels
+		}
+
+		newLabels := make(map[string]string, len(labels)+len(rule.Labels))
+		for k, v := range labels {
+			newLabels[k] = v
+		}
+		for k, v := range rule.Labels {
+			newLabels[k] = expand(v)
+		}
+
+		//the help of the original metric doesn't fit the others renamed
+		//the same way
+		newHelp := "EMQ metric " + name
+		if rule.Help != "" {
+			newHelp = expand(rule.Help)
+		}
+
+		return name, newHelp, newLabels
+	}
+
+	return fqName, help, labels
+}
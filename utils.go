@@ -1,23 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	usernameEnv = "EMQ_USERNAME"
-	passwordEnv = "EMQ_PASSWORD"
-)
-
 //Try to parse value from string to float64, return error on failure
 func parseString(s string) (float64, error) {
 	v, err := strconv.ParseFloat(s, 64)
@@ -37,84 +30,132 @@ func parseString(s string) (float64, error) {
 
 //newDesc returns a Prometheus description from a metric
 func newDesc(m metric) *prometheus.Desc {
-	return prometheus.NewDesc(m.name, m.help, nil, nil)
+	return prometheus.NewDesc(m.name, m.help, labelNames(m.labels), m.constLabels)
 }
 
 //neMetric returns a Prometheus metric from a metric
 func newMetric(m metric) (prometheus.Metric, error) {
-	return prometheus.NewConstMetric(newDesc(m), m.kind, m.value)
+	if h := m.histogram; h != nil {
+		return prometheus.NewConstHistogram(newDesc(m), h.Count, h.Sum, h.Buckets, labelValues(m.labels)...)
+	}
+	return prometheus.NewConstMetric(newDesc(m), m.kind, m.value, labelValues(m.labels)...)
 }
 
-//findCreds tries to find credentials in the follwing precedence:
-//1. Env vars - EMQ_USERNAME && EMQ_PASSWORD
-//2. A file under the specified path
-//returns the found username and password or error
-func findCreds(path string) (u, p string, err error) {
-	log.Debug().Msg("Loading credentails")
-	u, p, err = loadFromEnv()
-
-	if err != nil {
-		log.Debug().Msg(err.Error())
-		return loadFromFile(path)
+//metricKey identifies a metric by its name and labels. The separator isn't
+//valid UTF-8, so it can't appear in names or label values
+func metricKey(name string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range labelNames(labels) {
+		b.WriteByte(0xff)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
 	}
-
-	return
+	return b.String()
 }
 
-//loadFromEnv tries to find auth details in env vars
-func loadFromEnv() (u, p string, err error) {
-	log.Debug().Msg("Trying to load credentails from environment")
-	var ok bool
+//counterName adds the _total suffix to the name of a counter
+func counterName(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return name
+	}
+	return name + "_total"
+}
 
-	u, ok = os.LookupEnv(usernameEnv)
-	if !ok {
-		err = fmt.Errorf("Can't find %s", usernameEnv)
-		return
+//labelNames returns the sorted label names of a label set
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	p, ok = os.LookupEnv(passwordEnv)
-	if !ok {
-		err = fmt.Errorf("Can't find %s", passwordEnv)
-		return
+//labelValues returns the label values of a label set, ordered by label name
+func labelValues(labels map[string]string) []string {
+	names := labelNames(labels)
+	values := make([]string, 0, len(names))
+	for _, k := range names {
+		values = append(values, labels[k])
 	}
+	return values
+}
 
-	return
+//splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
 
-//loadFromFile tries to load auth details from a file
-func loadFromFile(path string) (u, p string, err error) {
-	log.Debug().Msg("Trying to load credentails from file")
-	var data map[string]string
+//targetKey normalizes the uri of an emq api, so the same api is matched
+//with or without a trailing slash
+func targetKey(uri string) string {
+	return strings.TrimSuffix(strings.TrimSpace(uri), "/")
+}
 
-	absPath, ferr := filepath.Abs(path)
-	if ferr != nil {
-		log.Debug().Msg(ferr.Error())
-		err = ferr
-		return
+//parseFloats parses a comma separated list of numbers
+func parseFloats(s string) ([]float64, error) {
+	var res []float64
+	for _, item := range splitList(s) {
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", item)
+		}
+		res = append(res, f)
 	}
+	return res, nil
+}
 
-	f, rerr := ioutil.ReadFile(absPath)
-	if rerr != nil {
-		log.Debug().Msg(rerr.Error())
-		err = rerr
-		return
+//formatFloats formats numbers as a comma separated list
+func formatFloats(fs []float64) string {
+	items := make([]string, 0, len(fs))
+	for _, f := range fs {
+		items = append(items, strconv.FormatFloat(f, 'g', -1, 64))
 	}
+	return strings.Join(items, ",")
+}
 
-	if jerr := json.Unmarshal(f, &data); jerr != nil {
-		log.Debug().Msg(jerr.Error())
-		err = jerr
-		return
-	}
+//labelsFlag is a flag.Value collecting comma separated key=value pairs
+type labelsFlag map[string]string
 
-	u = data["username"]
-	if u == "" {
-		err = fmt.Errorf("missing username in %s", path)
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for _, k := range labelNames(l) {
+		pairs = append(pairs, k+"="+l[k])
 	}
+	return strings.Join(pairs, ",")
+}
 
-	p = data["password"]
-	if p == "" {
-		err = fmt.Errorf("missing password in %s", path)
+func (l labelsFlag) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		if kv[0] == "node" {
+			return fmt.Errorf("label %q is reserved", kv[0])
+		}
+		l[kv[0]] = kv[1]
 	}
+	return nil
+}
+
+//patternsFlag is a flag.Value collecting the regular expressions given by a
+//repeated flag. They aren't split on commas, which are valid in patterns
+type patternsFlag []string
+
+func (p *patternsFlag) String() string {
+	return strings.Join(*p, " ")
+}
 
-	return
+func (p *patternsFlag) Set(s string) error {
+	*p = append(*p, s)
+	return nil
 }
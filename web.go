@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+//webConfig is the configuration of the exporter's web server, it follows
+//the format of the Prometheus exporter-toolkit web configuration file
+type webConfig struct {
+	TLSConfig      tlsServerConfig   `yaml:"tls_server_config"`
+	HTTPConfig     httpServerConfig  `yaml:"http_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+
+	//credentials already verified, so bcrypt only runs once per user
+	verified authCache
+}
+
+//authCache keeps the credentials that passed the bcrypt check, keyed by a
+//salted hash so the passwords aren't kept in memory
+type authCache struct {
+	mu   sync.Mutex
+	salt []byte
+	keys map[string]bool
+	//serializes the bcrypt checks, bounding the CPU that bad credentials
+	//can use
+	bcryptMu sync.Mutex
+}
+
+//key returns the cache key of the credentials, checked against hash
+func (c *authCache) key(user, pass, hash string) string {
+	c.mu.Lock()
+	if c.salt == nil {
+		c.salt = make([]byte, 16)
+		rand.Read(c.salt)
+	}
+	salt := c.salt
+	c.mu.Unlock()
+
+	h := sha256.New()
+	for _, s := range [][]byte{salt, []byte(user), []byte(hash), []byte(pass)} {
+		h.Write(s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//contains checks if the credentials were already verified
+func (c *authCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys[key]
+}
+
+//add keeps verified credentials, dropping an arbitrary entry when full
+func (c *authCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys == nil {
+		c.keys = make(map[string]bool)
+	}
+	if len(c.keys) >= maxVerifiedCredentials {
+		for k := range c.keys {
+			delete(c.keys, k)
+			break
+		}
+	}
+	c.keys[key] = true
+}
+
+type tlsServerConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites *bool    `yaml:"prefer_server_cipher_suites"`
+}
+
+type httpServerConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+//maximum number of verified credentials kept
+const maxVerifiedCredentials = 100
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS13": tls.VersionTLS13,
+		"TLS12": tls.VersionTLS12,
+		"TLS11": tls.VersionTLS11,
+		"TLS10": tls.VersionTLS10,
+	}
+
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+
+	curves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+
+	//hash compared against when the user is unknown, so unknown users take
+	//as long to reject as wrong passwords
+	dummyHash = []byte("$2a$10$ppIcnp250Y2II/ER36fgnO2zO0JcaUhh8LTcOxNkUe1iP0VZDe4uK")
+)
+
+//loadWebConfig reads and validates the web configuration file at path
+func loadWebConfig(path string) (*webConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &webConfig{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid web config %s: %v", path, err)
+	}
+
+	//relative paths are relative to the configuration file
+	dir := filepath.Dir(path)
+	for _, f := range []*string{&cfg.TLSConfig.CertFile, &cfg.TLSConfig.KeyFile, &cfg.TLSConfig.ClientCAs} {
+		if *f != "" && !filepath.IsAbs(*f) {
+			*f = filepath.Join(dir, *f)
+		}
+	}
+
+	for user, hash := range cfg.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %s: %v", user, err)
+		}
+	}
+
+	if _, err := cfg.TLSConfig.build(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+//enabled checks if TLS is configured
+func (c tlsServerConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+//build returns the tls.Config of the server, or nil when TLS isn't enabled
+func (c tlsServerConfig) build() (*tls.Config, error) {
+	if !c.enabled() {
+		if c.ClientCAs != "" || c.ClientAuth != "" {
+			return nil, fmt.Errorf("client authentication requires cert_file and key_file to be set")
+		}
+		return nil, nil
+	}
+
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("both cert_file and key_file must be set")
+	}
+
+	//make sure the key pair is valid on startup
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %v", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//reload the certificate on every handshake to pick up renewals
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			return &cert, err
+		},
+	}
+
+	var ok bool
+
+	if c.MinVersion != "" {
+		if cfg.MinVersion, ok = tlsVersions[c.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown min_version %s", c.MinVersion)
+		}
+	}
+
+	if c.MaxVersion != "" {
+		if cfg.MaxVersion, ok = tlsVersions[c.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown max_version %s", c.MaxVersion)
+		}
+	}
+
+	if cfg.ClientAuth, ok = clientAuthTypes[c.ClientAuth]; !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %s", c.ClientAuth)
+	}
+
+	if c.ClientCAs != "" {
+		b, err := ioutil.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client_ca_file: %v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in client_ca_file %s", c.ClientCAs)
+		}
+	}
+
+	if (cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert) && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file to be set", c.ClientAuth)
+	}
+
+	for _, name := range c.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	for _, name := range c.CurvePreferences {
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %s", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	if c.PreferServerCipherSuites != nil {
+		cfg.PreferServerCipherSuites = *c.PreferServerCipherSuites
+	}
+
+	return cfg, nil
+}
+
+//cipherSuite returns the id of a cipher suite by its name
+func cipherSuite(name string) (uint16, error) {
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if s.Name == name {
+			return s.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
+
+//authenticate checks the request's basic auth credentials against the
+//configured users. Verified credentials are cached, as bcrypt is slow by
+//design
+func (c *webConfig) authenticate(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	hash, found := c.BasicAuthUsers[user]
+	if !found {
+		hash = string(dummyHash)
+	}
+
+	key := c.verified.key(user, pass, hash)
+	if found && c.verified.contains(key) {
+		return true
+	}
+
+	c.verified.bcryptMu.Lock()
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	c.verified.bcryptMu.Unlock()
+
+	if !found || err != nil {
+		return false
+	}
+
+	c.verified.add(key)
+
+	return true
+}
+
+//handler wraps h with the configured headers and basic authentication
+func (c *webConfig) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range c.HTTPConfig.Headers {
+			w.Header().Set(k, v)
+		}
+
+		if len(c.BasicAuthUsers) > 0 && !c.authenticate(r) {
+			w.Header().Set("WWW-Authenticate", "Basic")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+//listenAndServe starts the server, using the web configuration file at
+//configPath if set to enable TLS and authentication
+func listenAndServe(server *http.Server, configPath string) error {
+	if configPath == "" {
+		return server.ListenAndServe()
+	}
+
+	cfg, err := loadWebConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	h := server.Handler
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	server.Handler = cfg.handler(h)
+
+	tc, err := cfg.TLSConfig.build()
+	if err != nil {
+		return err
+	}
+
+	if tc == nil {
+		log.Info().Msg("TLS is disabled")
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = tc
+
+	if cfg.HTTPConfig.HTTP2 != nil && !*cfg.HTTPConfig.HTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	log.Info().Msg("TLS is enabled")
+
+	return server.ListenAndServeTLS("", "")
+}
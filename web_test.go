@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Web configuration", func() {
+
+	Context("loading the configuration", func() {
+
+		It("should fail on a missing file", func() {
+			_, err := loadWebConfig("testdata/web/nothere.yml")
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail on unknown fields", func() {
+			_, err := loadWebConfig("testdata/web/unknown.yml")
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("field tls_config not found"))
+		})
+
+		It("should fail on invalid password hashes", func() {
+			_, err := loadWebConfig("testdata/web/badhash.yml")
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid bcrypt hash for user prometheus"))
+		})
+
+		It("should fail when client certificates can't be verified", func() {
+			_, err := loadWebConfig("testdata/web/clientauth.yml")
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("requires client_ca_file"))
+		})
+
+		It("should resolve paths relative to the configuration file", func() {
+			cfg, err := loadWebConfig("testdata/web/tls.yml")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.TLSConfig.CertFile).To(Equal("testdata/web/server.crt"))
+			Expect(cfg.TLSConfig.KeyFile).To(Equal("testdata/web/server.key"))
+		})
+	})
+
+	Context("building the TLS configuration", func() {
+
+		It("should be disabled without a certificate", func() {
+			tc, err := tlsServerConfig{}.build()
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tc).To(BeNil())
+		})
+
+		It("should fail on unknown versions", func() {
+			cfg, err := loadWebConfig("testdata/web/tls.yml")
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg.TLSConfig.MinVersion = "TLS14"
+			_, err = cfg.TLSConfig.build()
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("unknown min_version TLS14"))
+		})
+
+		It("should set the configured options", func() {
+			cfg, err := loadWebConfig("testdata/web/tls.yml")
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg.TLSConfig.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+			cfg.TLSConfig.CurvePreferences = []string{"X25519"}
+
+			tc, err := cfg.TLSConfig.build()
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tc.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(tc.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+			Expect(tc.CurvePreferences).To(Equal([]tls.CurveID{tls.X25519}))
+
+			cert, err := tc.GetCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert.Certificate).ToNot(BeEmpty())
+		})
+	})
+
+	Context("authenticating requests", func() {
+
+		var (
+			cfg *webConfig
+			h   http.Handler
+		)
+
+		BeforeEach(func() {
+			var err error
+			cfg, err = loadWebConfig("testdata/web/auth.yml")
+			Expect(err).ToNot(HaveOccurred())
+
+			h = cfg.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+		})
+
+		serve := func(user, pass string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if user != "" {
+				r.SetBasicAuth(user, pass)
+			}
+			h.ServeHTTP(rec, r)
+			return rec
+		}
+
+		It("should reject requests without credentials", func() {
+			rec := serve("", "")
+
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rec.Header().Get("WWW-Authenticate")).To(Equal("Basic"))
+		})
+
+		It("should reject unknown users", func() {
+			Expect(serve("admin", "secret").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject wrong passwords", func() {
+			Expect(serve("prometheus", "public").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should accept valid credentials", func() {
+			rec := serve("prometheus", "secret")
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(Equal("ok"))
+		})
+
+		It("should only cache the verified credentials", func() {
+			Expect(serve("prometheus", "public").Code).To(Equal(http.StatusUnauthorized))
+			Expect(cfg.verified.keys).To(BeEmpty())
+
+			Expect(serve("prometheus", "secret").Code).To(Equal(http.StatusOK))
+			Expect(cfg.verified.keys).To(HaveLen(1))
+
+			Expect(serve("prometheus", "secret").Code).To(Equal(http.StatusOK))
+			Expect(serve("prometheus", "public").Code).To(Equal(http.StatusUnauthorized))
+			Expect(cfg.verified.keys).To(HaveLen(1))
+		})
+
+		It("should set the configured headers", func() {
+			Expect(serve("", "").Header().Get("X-Frame-Options")).To(Equal("deny"))
+		})
+	})
+})